@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// accessLogger escribe una línea JSON por petición, separada del log.Printf habitual.
+var accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// statusRecorder guarda el código de estado y los bytes escritos en la respuesta.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// statusLogLevel separa en el log los errores del cliente (WARN) de los del servidor
+// (ERROR), para que un cliente que envía peticiones mal formadas no parezca un fallo.
+func statusLogLevel(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// accessLog registra método, ruta, estado, tamaño de la respuesta y duración de cada petición.
+func accessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		accessLogger.Log(r.Context(), statusLogLevel(status), "request",
+			"request_id", requestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"class", statusClass(status),
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		)
+	}
+}
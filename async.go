@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clave con la que se firman los callbacks (CALLBACK_SECRET). Vacía = modo asíncrono desactivado.
+var callbackSecret string
+
+// asyncJobs cuenta las generaciones en segundo plano para esperarlas al apagar el servidor.
+var asyncJobs sync.WaitGroup
+
+const (
+	callbackMaxAttempts = 3
+	callbackRetryDelay  = 2 * time.Second
+)
+
+// callbackClient entrega los resultados solo a IPs públicas, igual que imageURLClient, y
+// no sigue redirecciones: el receptor del callback es quien el cliente indicó.
+var callbackClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// asyncResult es el estado de un trabajo: lo que devuelve /jobs/{id} y, al terminar, el
+// body que se envía a callback_url.
+type asyncResult struct {
+	JobID       string      `json:"job_id"`
+	Status      string      `json:"status"`
+	ImageBase64 string      `json:"image_base64,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	MIMEType    string      `json:"mime_type,omitempty"`
+	Seed        *int32      `json:"seed,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Code        string      `json:"code,omitempty"`
+	Usage       *tokenUsage `json:"usage,omitempty"`
+}
+
+const (
+	jobStatusDone   = "done"
+	jobStatusFailed = "failed"
+)
+
+// checkCallbackURL admite solo URLs absolutas http/https. Las IPs privadas se rechazan
+// al conectar, como en image_url.
+func checkCallbackURL(rawURL string) error {
+	if callbackSecret == "" {
+		return errors.New("callback_url is not enabled on this server")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// startAsyncJob ejecuta run en segundo plano, guarda su estado en asyncJobStore y, si hay
+// callbackURL, le envía el resultado. Devuelve el ID del trabajo.
+func startAsyncJob(ctx context.Context, callbackURL string, run func(ctx context.Context) *asyncResult) string {
+	id := newRequestID()
+	asyncJobStore.create(id)
+
+	// El trabajo conserva los valores de la petición (ID, prioridad, parámetros, consumo)
+	// pero no su cancelación ni su plazo. Sin respuesta HTTP no hay cabecera para el alt text.
+	ctx = context.WithValue(context.WithoutCancel(ctx), altTextContextKey{}, (*strings.Builder)(nil))
+
+	asyncJobs.Add(1)
+	go func() {
+		defer asyncJobs.Done()
+		defer recoverJob(ctx, func() {
+			result := &asyncResult{JobID: id, Status: jobStatusFailed, Error: "internal server error", Code: codeInternalError}
+			asyncJobStore.finish(result)
+			if callbackURL != "" {
+				deliverCallback(ctx, callbackURL, result)
+			}
+		})
+		asyncJobStore.setRunning(id)
+		jobCtx, cancel := context.WithTimeout(ctx, generationTimeout)
+		result := run(jobCtx)
+		cancel()
+
+		result.JobID = id
+		result.Usage = usageFromContext(ctx)
+		asyncJobStore.finish(result)
+		logf(ctx, "Async job %s finished with status %s", id, result.Status)
+		if callbackURL != "" {
+			deliverCallback(ctx, callbackURL, result)
+		}
+	}()
+	return id
+}
+
+// imageJobResult prepara el resultado de un trabajo que generó una imagen: aplica el
+// límite de resolución y la sube al almacenamiento si lo hay.
+func imageJobResult(ctx context.Context, img []byte, mimeType string) *asyncResult {
+	if maxOutputWidth > 0 || maxOutputHeight > 0 {
+		if capped, cappedMime, _, err := capOutputResolution(img, mimeType); err != nil {
+			logf(ctx, "Error enforcing max output resolution: %v", err)
+		} else {
+			img, mimeType = capped, cappedMime
+		}
+	}
+
+	result := &asyncResult{Status: jobStatusDone, MIMEType: mimeType}
+	if imageStorage != nil {
+		url, err := storeImage(ctx, img, mimeType)
+		if err != nil {
+			logf(ctx, "Error storing image: %v", err)
+			return &asyncResult{Status: jobStatusFailed, Error: "failed to store image", Code: codeInternalError}
+		}
+		result.URL = url
+		return result
+	}
+	result.ImageBase64 = base64.StdEncoding.EncodeToString(img)
+	return result
+}
+
+// failedJobResult es el equivalente de writeGenerationError para un trabajo asíncrono.
+func failedJobResult(message string, err error) *asyncResult {
+	return &asyncResult{Status: jobStatusFailed, Error: message, Code: generationErrorCode(err)}
+}
+
+// deliverCallback envía el resultado firmado a callbackURL, reintentando ante errores de
+// red y respuestas 5xx.
+func deliverCallback(ctx context.Context, callbackURL string, result *asyncResult) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		logf(ctx, "Error encoding callback for job %s: %v", result.JobID, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := postCallback(ctx, callbackURL, result.JobID, body)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errCallbackRejected) || attempt >= callbackMaxAttempts {
+			logf(ctx, "Callback for job %s failed after %d attempts: %v", result.JobID, attempt, err)
+			return
+		}
+		logf(ctx, "Callback for job %s failed (attempt %d/%d), retrying: %v", result.JobID, attempt, callbackMaxAttempts, err)
+		time.Sleep(callbackRetryDelay * time.Duration(attempt))
+	}
+}
+
+// errCallbackRejected marca las respuestas 4xx del receptor, que no se reintentan.
+var errCallbackRejected = errors.New("callback rejected")
+
+func postCallback(ctx context.Context, callbackURL, jobID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCallbackRejected, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", jobID)
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+callbackSignature(timestamp, body))
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	if resp.StatusCode/100 == 4 {
+		return fmt.Errorf("%w: %s", errCallbackRejected, resp.Status)
+	}
+	return fmt.Errorf("callback returned %s", resp.Status)
+}
+
+// callbackSignature firma "<timestamp>.<body>" con HMAC-SHA256. Incluir el timestamp
+// permite al receptor descartar callbacks antiguos reenviados por un tercero.
+func callbackSignature(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(callbackSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
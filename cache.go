@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageCache es una caché LRU en memoria de imágenes generadas, con caducidad por entrada.
+type imageCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key        string
+	image      []byte
+	mimeType   string
+	usedPrompt string
+	altText    string
+	ratings    []safetyRating
+	expires    time.Time
+}
+
+func newImageCache(maxEntries int, ttl time.Duration) *imageCache {
+	return &imageCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *imageCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *imageCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.expires = time.Now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// generationCacheKey resume en un hash todo lo que determina la imagen generada: el
+// endpoint, el prompt y los parámetros efectivos de la petición (incluidos los del gateway).
+func generationCacheKey(ctx context.Context, endpoint, prompt string) string {
+	defaults := generationDefaultsFromContext(ctx)
+	params := generationParamsFromContext(ctx).cacheKey()
+
+	fields := []string{endpoint, modelFor(ctx), imageSizeFor(ctx), defaults.Style, params, fmt.Sprint(altTextFromContext(ctx) != nil), prompt}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateCached sirve la imagen desde la caché si existe y, si no, la genera con
+// generateWithSoftening y la guarda. Sin caché configurada solo genera.
+func generateCached(ctx context.Context, endpoint, prompt string) ([]byte, string, string, bool, error) {
+	if generationCache == nil {
+		imgBytes, mimeType, usedPrompt, err := generateWithSoftening(ctx, prompt)
+		return imgBytes, mimeType, usedPrompt, false, err
+	}
+
+	key := generationCacheKey(ctx, endpoint, prompt)
+	if entry, ok := generationCache.get(key); ok {
+		if altText := altTextFromContext(ctx); altText != nil {
+			altText.WriteString(entry.altText)
+		}
+		setSafetyRatings(ctx, entry.ratings)
+		return entry.image, entry.mimeType, entry.usedPrompt, true, nil
+	}
+
+	imgBytes, mimeType, usedPrompt, err := generateWithSoftening(ctx, prompt)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	entry := &cacheEntry{key: key, image: imgBytes, mimeType: mimeType, usedPrompt: usedPrompt, ratings: safetyRatingsFromContext(ctx)}
+	if altText := altTextFromContext(ctx); altText != nil {
+		entry.altText = altText.String()
+	}
+	generationCache.put(entry)
+	return imgBytes, mimeType, usedPrompt, false, nil
+}
+
+// setCacheHeader indica en X-Cache si la imagen salió de la caché.
+func setCacheHeader(w http.ResponseWriter, hit bool) {
+	if generationCache == nil {
+		return
+	}
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+}
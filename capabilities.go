@@ -0,0 +1,87 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Sondeo opcional de los modelos al arrancar (MODEL_PROBE_ENABLED). La API de modelos
+// informa de las acciones que admite cada modelo y de su temperatura máxima, pero no de
+// los tamaños ni de las relaciones de aspecto, así que size y aspect_ratio siguen usando
+// sus listas fijas.
+
+const (
+	defaultMaxTemperature = 2
+	modelProbeTimeout     = 30 * time.Second
+)
+
+// modelCapabilities es lo que el sondeo averiguó de un modelo.
+type modelCapabilities struct {
+	MaxTemperature float32
+}
+
+// probedModels guarda el resultado del sondeo, que se hace una sola vez al arrancar. Un
+// modelo que no está (sin sondeo o porque falló) usa los límites fijos.
+var probedModels map[string]modelCapabilities
+
+// modelLookup consulta un modelo en la API; en main es client.Models.Get.
+type modelLookup func(ctx context.Context, model string) (*genai.Model, error)
+
+// probeModels consulta el modelo por defecto y los de ALLOWED_MODELS. Devuelve las
+// capacidades de los que respondieron y la lista de permitidos sin los que no existen o
+// no admiten generateContent. El modelo por defecto nunca se descarta: sin él no hay
+// servicio, y el error se verá en la primera generación.
+func probeModels(ctx context.Context, lookup modelLookup, defaultModel string, allowed []string) (map[string]modelCapabilities, []string) {
+	ctx, cancel := context.WithTimeout(ctx, modelProbeTimeout)
+	defer cancel()
+
+	probed := map[string]modelCapabilities{}
+	if caps, ok, _ := probeModel(ctx, lookup, defaultModel); ok {
+		probed[defaultModel] = caps
+	}
+	kept := []string{}
+	for _, model := range allowed {
+		caps, ok, usable := probeModel(ctx, lookup, model)
+		if ok {
+			probed[model] = caps
+		}
+		if !usable {
+			log.Printf("Model probe: removing %s from ALLOWED_MODELS", model)
+			continue
+		}
+		kept = append(kept, model)
+	}
+	return probed, kept
+}
+
+// probeModel consulta un modelo. ok indica si hay capacidades que usar; usable es false
+// solo si la API confirma que el modelo no existe o no genera contenido. Cualquier otro
+// fallo deja el modelo con los límites fijos.
+func probeModel(ctx context.Context, lookup modelLookup, model string) (caps modelCapabilities, ok, usable bool) {
+	info, err := lookup(ctx, model)
+	if err != nil {
+		var apiErr genai.APIError
+		notFound := errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+		log.Printf("Model probe for %s failed, using static limits: %v", model, err)
+		return caps, false, !notFound
+	}
+	if len(info.SupportedActions) > 0 && !slices.Contains(info.SupportedActions, "generateContent") {
+		log.Printf("Model probe: %s does not support generateContent", model)
+		return caps, false, false
+	}
+	log.Printf("Model probe: %s (max temperature %g)", model, info.MaxTemperature)
+	return modelCapabilities{MaxTemperature: info.MaxTemperature}, true, true
+}
+
+// maxTemperatureFor devuelve la temperatura máxima que se acepta para el modelo: la que
+// informó el sondeo o, sin ella, el límite fijo.
+func maxTemperatureFor(model string) float32 {
+	return cmp.Or(probedModels[model].MaxTemperature, defaultMaxTemperature)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subidas por partes para imágenes grandes o redes inestables: el cliente crea la subida
+// con el tamaño total, envía la imagen en trozos con PUT y, si la conexión se corta,
+// consulta con GET cuántos bytes llegaron y continúa desde ahí. Los endpoints de edición
+// la usan con image_upload_id. Las partes se guardan en disco y caducan pasado ttl sin
+// actividad. Cada subida pertenece a la API key que la creó, y las subidas pendientes
+// de una key no pueden ocupar más de quota bytes.
+type uploadStore struct {
+	mu      sync.Mutex
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+	quota   int64
+	uploads map[string]*chunkedUpload
+}
+
+// chunkedUpload guarda el estado de una subida. offset, expires y removed se protegen con
+// mu, que también serializa las escrituras de trozos de la misma subida.
+type chunkedUpload struct {
+	mu      sync.Mutex
+	id      string
+	owner   string // API key que creó la subida
+	path    string
+	size    int64 // tamaño total declarado
+	offset  int64 // bytes recibidos
+	expires time.Time
+	removed bool // ya no está en el store y su fichero se ha borrado
+}
+
+// uploadStatus es la respuesta de los endpoints de /uploads.
+type uploadStatus struct {
+	UploadID  string    `json:"upload_id"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Complete  bool      `json:"complete"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type CreateUploadRequest struct {
+	Size int64 `json:"size"`
+}
+
+// Extensión de los ficheros de las subidas; al arrancar se borran los que quedaron
+const uploadFileExt = ".part"
+
+var (
+	errUploadNotFound   = errors.New("upload not found or expired")
+	errUploadIncomplete = errors.New("upload is not complete")
+	errUploadQuota      = errors.New("upload quota exceeded")
+)
+
+var chunkedUploads = &uploadStore{
+	dir:     filepath.Join(os.TempDir(), "image-uploads"),
+	ttl:     time.Hour,
+	maxSize: 30 << 20,
+	quota:   100 << 20,
+	uploads: make(map[string]*chunkedUpload),
+}
+
+// init prepara el directorio y descarta las subidas de una ejecución anterior, que ya no
+// se pueden continuar porque el estado está en memoria.
+func (s *uploadStore) init() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(s.dir, "*"+uploadFileExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// expireLoop borra cada minuto las subidas caducadas, aunque no lleguen peticiones nuevas.
+func (s *uploadStore) expireLoop() {
+	for range time.Tick(time.Minute) {
+		s.expire()
+	}
+}
+
+func (s *uploadStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, upload := range s.uploads {
+		// Si upload.mu está bloqueado la subida está recibiendo un trozo o leyéndose, así
+		// que no ha caducado: se revisa en la siguiente pasada
+		if !upload.mu.TryLock() {
+			continue
+		}
+		if now.After(upload.expires) {
+			delete(s.uploads, id)
+			upload.discard()
+		}
+		upload.mu.Unlock()
+	}
+}
+
+func (s *uploadStore) create(owner string, size int64) (*chunkedUpload, error) {
+	s.expire()
+
+	id := newRequestID()
+	upload := &chunkedUpload{
+		id:      id,
+		owner:   owner,
+		path:    filepath.Join(s.dir, id+uploadFileExt),
+		size:    size,
+		expires: time.Now().Add(s.ttl),
+	}
+
+	// La cuota se reserva con el tamaño declarado, antes de recibir ningún byte
+	s.mu.Lock()
+	if s.usage(owner)+size > s.quota {
+		s.mu.Unlock()
+		return nil, errUploadQuota
+	}
+	s.uploads[id] = upload
+	s.mu.Unlock()
+
+	file, err := os.OpenFile(upload.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		s.remove(id, owner)
+		return nil, err
+	}
+	file.Close()
+	return upload, nil
+}
+
+// usage suma el tamaño declarado de las subidas de owner. Requiere s.mu.
+func (s *uploadStore) usage(owner string) int64 {
+	var total int64
+	for _, upload := range s.uploads {
+		if upload.owner == owner {
+			total += upload.size
+		}
+	}
+	return total
+}
+
+// get devuelve la subida si existe y es de owner. Las de otra API key se tratan como
+// inexistentes, para no revelar qué IDs están en uso.
+func (s *uploadStore) get(id, owner string) (*chunkedUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.owner != owner {
+		return nil, false
+	}
+	// Como en expire, una subida en uso no ha caducado. Quien la use debe comprobar
+	// removed después de bloquear upload.mu, por si caducó entre tanto.
+	if upload.mu.TryLock() {
+		expired := time.Now().After(upload.expires)
+		if expired {
+			delete(s.uploads, id)
+			upload.discard()
+		}
+		upload.mu.Unlock()
+		if expired {
+			return nil, false
+		}
+	}
+	return upload, true
+}
+
+// remove descarta la subida. Si está recibiendo un trozo, espera a que termine antes de
+// borrar el fichero.
+func (s *uploadStore) remove(id, owner string) bool {
+	s.mu.Lock()
+	upload, ok := s.uploads[id]
+	if !ok || upload.owner != owner {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.uploads, id)
+	s.mu.Unlock()
+
+	upload.mu.Lock()
+	upload.discard()
+	upload.mu.Unlock()
+	return true
+}
+
+// read devuelve el contenido de una subida completa. La subida se conserva hasta que
+// caduca, para que el cliente pueda repetir la edición sin volver a subir la imagen.
+func (s *uploadStore) read(id, owner string) ([]byte, error) {
+	upload, ok := s.get(id, owner)
+	if !ok {
+		return nil, errUploadNotFound
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.removed {
+		return nil, errUploadNotFound
+	}
+	if upload.offset < upload.size {
+		return nil, errUploadIncomplete
+	}
+	upload.expires = time.Now().Add(s.ttl)
+	return os.ReadFile(upload.path)
+}
+
+// discard marca la subida como eliminada y borra su fichero. Requiere u.mu.
+func (u *chunkedUpload) discard() {
+	u.removed = true
+	os.Remove(u.path)
+}
+
+// status debe llamarse con upload.mu bloqueado.
+func (u *chunkedUpload) status() uploadStatus {
+	return uploadStatus{
+		UploadID:  u.id,
+		Size:      u.size,
+		Offset:    u.offset,
+		Complete:  u.offset == u.size,
+		ExpiresAt: u.expires.UTC().Truncate(time.Second),
+	}
+}
+
+// appendChunk añade el body a la subida. Si la conexión se corta a mitad del trozo, lo
+// recibido hasta entonces se conserva y el cliente reanuda desde el nuevo offset.
+func (u *chunkedUpload) appendChunk(body io.Reader, ttl time.Duration) error {
+	file, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, body)
+	u.offset += n
+	u.expires = time.Now().Add(ttl)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeUploadStatus(w http.ResponseWriter, status uploadStatus, statusCode int) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(status.Offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleCreateUpload crea una subida por partes de size bytes.
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CreateUploadRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Size <= 0 {
+		writeError(w, codeInvalidParameter, "size must be a positive number of bytes", http.StatusBadRequest)
+		return
+	}
+	if req.Size > chunkedUploads.maxSize {
+		writeError(w, codeBodyTooLarge, fmt.Sprintf("Upload too large. Maximum size: %d MB", chunkedUploads.maxSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload, err := chunkedUploads.create(apiKeyFromContext(r.Context()), req.Size)
+	if errors.Is(err, errUploadQuota) {
+		writeError(w, codeUploadQuotaExceeded, fmt.Sprintf("pending uploads for this API key would exceed %d MB; delete the ones no longer needed or wait for them to expire", chunkedUploads.quota>>20), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Error creating upload: %v", err)
+		writeError(w, codeInternalError, "could not create upload", http.StatusInternalServerError)
+		return
+	}
+	upload.mu.Lock()
+	status := upload.status()
+	upload.mu.Unlock()
+
+	w.Header().Set("Location", "/uploads/"+upload.id)
+	writeUploadStatus(w, status, http.StatusCreated)
+}
+
+// handleUpload atiende /uploads/{id}: GET consulta el progreso, PUT añade un trozo en
+// la posición de la cabecera Upload-Offset y DELETE descarta la subida.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	owner := apiKeyFromContext(r.Context())
+
+	if r.Method == http.MethodDelete {
+		if !chunkedUploads.remove(id, owner) {
+			writeError(w, codeUploadNotFound, errUploadNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeError(w, codeMethodNotAllowed, "GET, PUT or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, ok := chunkedUploads.get(id, owner)
+	if !ok {
+		writeError(w, codeUploadNotFound, errUploadNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.removed {
+		writeError(w, codeUploadNotFound, errUploadNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeUploadStatus(w, upload.status(), http.StatusOK)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, codeInvalidHeader, "Upload-Offset header must be the number of bytes already uploaded", http.StatusBadRequest)
+		return
+	}
+	// Un offset distinto suele ser un reintento de un trozo que sí llegó: se responde
+	// con el offset real para que el cliente continúe desde ahí
+	if offset != upload.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		writeError(w, codeUploadOffsetMismatch, fmt.Sprintf("Upload-Offset is %d but %d bytes have been received", offset, upload.offset), http.StatusConflict)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, upload.size-upload.offset)
+	if err := upload.appendChunk(body, chunkedUploads.ttl); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+			writeError(w, codeBodyTooLarge, fmt.Sprintf("chunk exceeds the declared upload size of %d bytes", upload.size), http.StatusRequestEntityTooLarge)
+			return
+		}
+		logf(r.Context(), "Error writing upload chunk (offset %d): %v", upload.offset, err)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		writeError(w, codeInternalError, "could not store chunk", http.StatusInternalServerError)
+		return
+	}
+	if upload.offset == upload.size {
+		logf(r.Context(), "Upload %s complete (%d bytes)", upload.id, upload.size)
+	}
+	writeUploadStatus(w, upload.status(), http.StatusOK)
+}
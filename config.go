@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config reúne la configuración del servidor leída de las variables de entorno. Se carga
+// y valida una sola vez al arrancar: un valor mal escrito detiene el arranque en lugar de
+// ignorarse y dejar el valor por defecto sin avisar.
+type Config struct {
+	GoogleAPIKey string
+	Model        string
+	Port         string
+	AdminAPIKey  string
+
+	AllowedModels []string
+
+	GenAIBackend         string
+	GoogleCloudProject   string
+	GoogleCloudLocation  string
+	GenAICredentialsFile string
+	GenAIBaseURL         string
+	GenAIAPIVersion      string
+
+	MaxBodySize     int64
+	MaxEditBodySize int64
+	MaxPromptLength int
+
+	PromptLengthPolicy string
+
+	ImageURLAllowedHosts []string
+	ImageURLMaxSize      int64
+	ImageURLTimeout      time.Duration
+
+	MaxImageDimension int
+	MaxOutputWidth    int
+	MaxOutputHeight   int
+
+	SafetySoftenEnabled bool
+	SafetySoftenTerms   []string
+
+	LaneSizeHigh             int
+	LaneSizeNormal           int
+	LaneSizeLow              int
+	MaxConcurrentGenerations int
+	PacerRPM                 float64
+	RateLimitRPM             float64
+
+	CacheMaxEntries int
+	CacheTTL        time.Duration
+
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+
+	OptimizeFormats     []string
+	OptimizeJPEGQuality int
+
+	EntropyCheckEnabled bool
+	MinImageEntropy     float64
+	EntropyCheckRetries int
+
+	LQIPEnabled    bool
+	AltTextEnabled bool
+
+	GenerationTimeout time.Duration
+	ShutdownTimeout   time.Duration
+
+	AllowedOrigins     []string
+	StorageBackend     string
+	StorageKeyStrategy string
+	StorageURLTTL      time.Duration
+
+	CallbackSecret string
+	JobTTL         time.Duration
+
+	UploadDir     string
+	UploadTTL     time.Duration
+	MaxUploadSize int64
+	UploadQuota   int64
+
+	WarmUpEnabled bool
+	WarmUpPrompt  string
+
+	ModelProbeEnabled bool
+
+	WatermarkText     string
+	WatermarkImage    string
+	WatermarkPosition string
+	WatermarkOpacity  float64
+
+	PromptBlocklist     []string
+	PromptBlocklistFile string
+}
+
+// loadConfig lee la configuración del entorno. Devuelve todos los errores a la vez para
+// no obligar a corregir las variables de una en una.
+func loadConfig() (*Config, error) {
+	env := &envReader{}
+	cfg := &Config{
+		GoogleAPIKey: os.Getenv("GOOGLE_API_KEY"),
+		Model:        env.string("GEMINI_MODEL", modelName),
+		Port:         env.string("PORT", "8080"),
+		AdminAPIKey:  os.Getenv("ADMIN_API_KEY"),
+
+		AllowedModels: env.list("ALLOWED_MODELS"),
+
+		GenAIBackend:         strings.ToLower(env.string("GENAI_BACKEND", backendGemini)),
+		GoogleCloudProject:   os.Getenv("GOOGLE_CLOUD_PROJECT"),
+		GoogleCloudLocation:  os.Getenv("GOOGLE_CLOUD_LOCATION"),
+		GenAICredentialsFile: os.Getenv("GENAI_CREDENTIALS_FILE"),
+		GenAIBaseURL:         os.Getenv("GENAI_BASE_URL"),
+		GenAIAPIVersion:      os.Getenv("GENAI_API_VERSION"),
+
+		MaxBodySize:     env.megabytes("MAX_BODY_SIZE_MB", 100<<20),
+		MaxEditBodySize: env.megabytes("MAX_EDIT_BODY_SIZE_MB", 30<<20),
+		MaxPromptLength: env.int("MAX_PROMPT_LENGTH", maxPromptLength, 1),
+
+		PromptLengthPolicy: env.string("PROMPT_LENGTH_POLICY", promptLengthPolicy),
+
+		ImageURLAllowedHosts: env.list("IMAGE_URL_ALLOWED_HOSTS"),
+		ImageURLMaxSize:      env.megabytes("IMAGE_URL_MAX_SIZE_MB", maxImageURLBytes),
+		ImageURLTimeout:      env.seconds("IMAGE_URL_TIMEOUT_SECONDS", imageURLTimeout),
+
+		MaxImageDimension: env.int("MAX_IMAGE_DIMENSION", maxImageDimension, 1),
+		MaxOutputWidth:    env.int("MAX_OUTPUT_WIDTH", 0, 0),
+		MaxOutputHeight:   env.int("MAX_OUTPUT_HEIGHT", 0, 0),
+
+		SafetySoftenEnabled: env.bool("SAFETY_SOFTEN_ENABLED"),
+		SafetySoftenTerms:   env.list("SAFETY_SOFTEN_TERMS"),
+
+		LaneSizeHigh:             env.int("LANE_SIZE_HIGH", 0, 0),
+		LaneSizeNormal:           env.int("LANE_SIZE_NORMAL", 0, 0),
+		LaneSizeLow:              env.int("LANE_SIZE_LOW", 0, 0),
+		MaxConcurrentGenerations: env.int("MAX_CONCURRENT_GENERATIONS", 0, 0),
+		PacerRPM:                 env.float("PACER_RPM", 0),
+		RateLimitRPM:             env.float("RATE_LIMIT_RPM", 0),
+
+		CacheMaxEntries: env.int("CACHE_MAX_ENTRIES", 0, 0),
+		CacheTTL:        env.seconds("CACHE_TTL_SECONDS", time.Hour),
+
+		RetryMaxAttempts: env.int("RETRY_MAX_ATTEMPTS", retryMaxAttempts, 1),
+		RetryBaseDelay:   env.milliseconds("RETRY_BASE_DELAY_MS", retryBaseDelay),
+
+		OptimizeFormats:     env.optimizeFormats("OPTIMIZE_FORMATS", optimizeFormats),
+		OptimizeJPEGQuality: env.int("OPTIMIZE_JPEG_QUALITY", optimizeJPEGQuality, 1),
+
+		EntropyCheckEnabled: env.bool("ENTROPY_CHECK_ENABLED"),
+		MinImageEntropy:     env.float("MIN_IMAGE_ENTROPY", minImageEntropy),
+		EntropyCheckRetries: env.int("ENTROPY_CHECK_RETRIES", entropyCheckRetries, 0),
+
+		LQIPEnabled:    env.bool("LQIP_ENABLED"),
+		AltTextEnabled: env.bool("ALT_TEXT_ENABLED"),
+
+		GenerationTimeout: env.seconds("GENERATION_TIMEOUT_SECONDS", generationTimeout),
+
+		AllowedOrigins:     parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS")),
+		StorageBackend:     os.Getenv("STORAGE_BACKEND"),
+		StorageKeyStrategy: env.string("STORAGE_KEY_STRATEGY", storageKeyStrategy),
+		StorageURLTTL:      time.Duration(env.int("STORAGE_URL_TTL_SECONDS", 0, 0)) * time.Second,
+
+		CallbackSecret: os.Getenv("CALLBACK_SECRET"),
+		JobTTL:         env.seconds("JOB_TTL_SECONDS", asyncJobStore.ttl),
+
+		UploadDir:   env.string("UPLOAD_DIR", chunkedUploads.dir),
+		UploadTTL:   env.seconds("UPLOAD_TTL_SECONDS", chunkedUploads.ttl),
+		UploadQuota: env.megabytes("UPLOAD_QUOTA_MB", chunkedUploads.quota),
+
+		WarmUpEnabled: env.bool("WARMUP_ENABLED"),
+		WarmUpPrompt:  env.string("WARMUP_PROMPT", defaultWarmUpPrompt),
+
+		ModelProbeEnabled: env.bool("MODEL_PROBE_ENABLED"),
+
+		WatermarkText:     env.string("WATERMARK_TEXT", defaultWatermarkText),
+		WatermarkImage:    os.Getenv("WATERMARK_IMAGE"),
+		WatermarkPosition: env.string("WATERMARK_POSITION", watermarkPosition),
+		WatermarkOpacity:  env.float("WATERMARK_OPACITY", watermarkOpacity),
+
+		PromptBlocklist:     env.list("PROMPT_BLOCKLIST"),
+		PromptBlocklistFile: os.Getenv("PROMPT_BLOCKLIST_FILE"),
+	}
+	// Por defecto, el plazo de apagado es el de una generación
+	cfg.ShutdownTimeout = env.seconds("SHUTDOWN_TIMEOUT_SECONDS", cfg.GenerationTimeout)
+
+	switch cfg.GenAIBackend {
+	case backendGemini:
+		if cfg.GoogleAPIKey == "" {
+			env.errs = append(env.errs, errors.New("GOOGLE_API_KEY is required (set the environment variable or create a .env file)"))
+		}
+		if cfg.GenAICredentialsFile != "" {
+			env.errs = append(env.errs, errors.New("GENAI_CREDENTIALS_FILE requires GENAI_BACKEND=vertex"))
+		}
+	case backendVertex:
+		if cfg.GoogleCloudProject == "" && cfg.GoogleAPIKey == "" {
+			env.errs = append(env.errs, errors.New("GENAI_BACKEND=vertex requires GOOGLE_CLOUD_PROJECT (or GOOGLE_API_KEY for express mode)"))
+		}
+	default:
+		env.errs = append(env.errs, fmt.Errorf("GENAI_BACKEND: %q is not gemini or vertex", cfg.GenAIBackend))
+	}
+	if cfg.GenAIBaseURL != "" {
+		if u, err := url.Parse(cfg.GenAIBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			env.errs = append(env.errs, fmt.Errorf("GENAI_BASE_URL: %q is not an absolute http or https URL", cfg.GenAIBaseURL))
+		}
+	}
+	for _, model := range cfg.AllowedModels {
+		if !modelNamePattern.MatchString(model) {
+			env.fail("ALLOWED_MODELS", model, "a valid model name")
+		}
+	}
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		env.errs = append(env.errs, fmt.Errorf("PORT: %q is not a valid port", cfg.Port))
+	}
+	if cfg.OptimizeJPEGQuality > 100 {
+		env.errs = append(env.errs, fmt.Errorf("OPTIMIZE_JPEG_QUALITY: must be between 1 and 100"))
+	}
+	if !slices.Contains(watermarkPositions, cfg.WatermarkPosition) {
+		env.errs = append(env.errs, fmt.Errorf("WATERMARK_POSITION: must be one of %s", strings.Join(watermarkPositions, ", ")))
+	}
+	if !slices.Contains(promptLengthPolicies, cfg.PromptLengthPolicy) {
+		env.errs = append(env.errs, fmt.Errorf("PROMPT_LENGTH_POLICY: must be one of %s", strings.Join(promptLengthPolicies, ", ")))
+	}
+	if cfg.StorageURLTTL > maxStorageURLTTL {
+		env.errs = append(env.errs, fmt.Errorf("STORAGE_URL_TTL_SECONDS: must be at most %d (7 days)", int(maxStorageURLTTL/time.Second)))
+	}
+	if !slices.Contains(storageKeyStrategies, cfg.StorageKeyStrategy) {
+		env.errs = append(env.errs, fmt.Errorf("STORAGE_KEY_STRATEGY: must be one of %s", strings.Join(storageKeyStrategies, ", ")))
+	}
+	if cfg.WatermarkOpacity > 1 {
+		env.errs = append(env.errs, fmt.Errorf("WATERMARK_OPACITY: must be between 0 and 1"))
+	}
+	if cfg.MaxEditBodySize > cfg.MaxBodySize {
+		log.Printf("Warning: MAX_EDIT_BODY_SIZE_MB is larger than MAX_BODY_SIZE_MB, using %d MB", cfg.MaxBodySize>>20)
+		cfg.MaxEditBodySize = cfg.MaxBodySize
+	}
+	// Una subida completa se lee entera en memoria para enviarla al modelo, así que no
+	// puede superar el límite de los endpoints de edición
+	cfg.MaxUploadSize = env.megabytes("MAX_UPLOAD_SIZE_MB", cfg.MaxEditBodySize)
+	if cfg.MaxUploadSize > cfg.MaxEditBodySize {
+		log.Printf("Warning: MAX_UPLOAD_SIZE_MB is larger than MAX_EDIT_BODY_SIZE_MB, using %d MB", cfg.MaxEditBodySize>>20)
+		cfg.MaxUploadSize = cfg.MaxEditBodySize
+	}
+
+	if err := errors.Join(env.errs...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envReader lee variables de entorno tipadas y acumula los errores de formato.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(name, value, expected string) {
+	e.errs = append(e.errs, fmt.Errorf("%s: %q is not %s", name, value, expected))
+}
+
+func (e *envReader) string(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// int lee un entero mayor o igual que minValue.
+func (e *envReader) int(name string, def, minValue int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minValue {
+		e.fail(name, v, fmt.Sprintf("an integer >= %d", minValue))
+		return def
+	}
+	return n
+}
+
+// float lee un número no negativo.
+func (e *envReader) float(name string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		e.fail(name, v, "a non-negative number")
+		return def
+	}
+	return f
+}
+
+func (e *envReader) bool(name string) bool {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(name, v, "true or false")
+		return false
+	}
+	return b
+}
+
+// megabytes lee un tamaño en MB y lo devuelve en bytes.
+func (e *envReader) megabytes(name string, def int64) int64 {
+	return int64(e.int(name, int(def>>20), 1)) << 20
+}
+
+func (e *envReader) seconds(name string, def time.Duration) time.Duration {
+	return time.Duration(e.int(name, int(def/time.Second), 1)) * time.Second
+}
+
+func (e *envReader) milliseconds(name string, def time.Duration) time.Duration {
+	return time.Duration(e.int(name, int(def/time.Millisecond), 1)) * time.Millisecond
+}
+
+// list lee una lista separada por comas, sin elementos vacíos.
+func (e *envReader) list(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// optimizeFormats lee los formatos candidatos de optimize=true. WebP se acepta pero se
+// descarta con un aviso, porque no hay codificador WebP en Go puro.
+func (e *envReader) optimizeFormats(name string, def []string) []string {
+	if os.Getenv(name) == "" {
+		return def
+	}
+	var formats []string
+	for _, format := range e.list(name) {
+		switch format = strings.ToLower(format); format {
+		case "png", "jpeg":
+			formats = append(formats, format)
+		case "webp":
+			log.Printf("Warning: %s: webp encoding is not supported, skipping", name)
+		default:
+			e.fail(name, format, "a supported format (png, jpeg)")
+		}
+	}
+	return formats
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Orígenes admitidos para CORS (ALLOWED_ORIGINS). Vacío = CORS desactivado.
+var allowedOrigins []string
+
+// Cabeceras de la API que el navegador necesita enviar o poder leer
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Accept, Upload-Offset, X-API-Key, X-Admin-Key, X-Debug, X-Generation-Config, X-Request-ID"
+	corsExposeHeaders = "Location, Retry-After, Upload-Offset, X-Alt-Text, X-Cache, X-Effective-Prompt, X-Image-Downscaled, X-Image-Format, X-Image-Height, X-Image-Width, X-LQIP, X-Optimize-Format, X-Optimize-Sizes, X-Preview, X-Prompt-Softened, X-Prompt-Truncated, X-Request-ID, X-Seed, X-Upstream-Request-ID, X-Usage-Tokens"
+)
+
+func parseAllowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// corsOrigin devuelve el valor de Access-Control-Allow-Origin para origin, o "" si no
+// está permitido.
+func corsOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	if slices.Contains(allowedOrigins, "*") {
+		return "*"
+	}
+	if slices.Contains(allowedOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+// cors añade las cabeceras CORS para los orígenes de ALLOWED_ORIGINS y responde a los
+// preflight OPTIONS sin llegar a los handlers, que solo aceptan POST o GET.
+func cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedOrigins) == 0 {
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowOrigin := corsOrigin(r.Header.Get("Origin"))
+		if allowOrigin == "" {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next(w, r)
+	}
+}
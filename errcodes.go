@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Códigos estables del campo "code" de las respuestas de error. Los clientes deben
+// decidir en función del código; el texto de "error" puede cambiar.
+const (
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeNotFound             = "not_found"
+	codeInvalidBody          = "invalid_body"
+	codeBodyTooLarge         = "body_too_large"
+	codeInvalidParameter     = "invalid_parameter"
+	codeInvalidHeader        = "invalid_header"
+	codeMissingPrompt        = "missing_prompt"
+	codeMissingImage         = "missing_image"
+	codeMissingFields        = "missing_fields"
+	codeInvalidBase64        = "invalid_base64"
+	codeInvalidImageURL      = "invalid_image_url"
+	codeInvalidImage         = "invalid_image"
+	codeImageTooLarge        = "image_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeMissingAPIKey        = "missing_api_key"
+	codeInvalidAPIKey        = "invalid_api_key"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeRateLimited          = "rate_limited"
+	codeForbidden            = "forbidden"
+	codeInternalError        = "internal_error"
+	codeUpstreamError        = "upstream_error"
+	codeUpstreamAuthError    = "upstream_auth_error"
+	codeServiceNotReady      = "service_not_ready"
+	codeGenerationTimeout    = "generation_timeout"
+	codeDegenerateImage      = "degenerate_image"
+	codeContentBlocked       = "content_blocked"
+	codeNoImage              = "no_image"
+	codeClientClosedRequest  = "client_closed_request"
+	codePromptRejected       = "prompt_rejected"
+	codeUploadNotFound       = "upload_not_found"
+	codeUploadIncomplete     = "upload_incomplete"
+	codeUploadOffsetMismatch = "upload_offset_mismatch"
+	codeUploadQuotaExceeded  = "upload_quota_exceeded"
+)
+
+// imageErrorCode distingue una imagen demasiado grande de una que no se puede leer.
+func imageErrorCode(err error) string {
+	var tooLarge *imageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return codeImageTooLarge
+	}
+	return codeInvalidImage
+}
+
+// generationErrorCode es el equivalente de generationErrorStatus para el campo "code".
+func generationErrorCode(err error) string {
+	if errors.Is(err, errServiceNotReady) {
+		return codeServiceNotReady
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codeGenerationTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return codeClientClosedRequest
+	}
+	var lowEntropy *lowEntropyError
+	if errors.As(err, &lowEntropy) {
+		return codeDegenerateImage
+	}
+	if upstreamAuthError(err) {
+		return codeUpstreamAuthError
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		return codeContentBlocked
+	}
+	var noImage *noImageError
+	if errors.As(err, &noImage) {
+		return codeNoImage
+	}
+	return codeUpstreamError
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// Las fotos de móvil guardan la imagen tal como la captura el sensor y una etiqueta EXIF
+// Orientation que indica cómo girarla. El modelo no siempre la respeta, así que las
+// imágenes de entrada se enderezan antes de enviarlas. Solo JPEG lleva EXIF en la práctica.
+
+const exifOrientationTag = 0x0112
+
+// autoOrient devuelve la imagen girada según su orientación EXIF y sin EXIF. Si no es un
+// JPEG, no tiene EXIF o no se puede procesar, devuelve los bytes tal cual: la validación
+// posterior del handler se encarga de rechazar las imágenes inválidas.
+func autoOrient(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return data
+	}
+	stripped, orientation, ok := stripJPEGExif(data)
+	if !ok {
+		return data
+	}
+	if orientation < 2 || orientation > 8 {
+		return stripped
+	}
+
+	// No se decodifica una imagen que luego se va a rechazar por tamaño
+	if err := checkImageDimensions(stripped, maxImageDimension); err != nil {
+		return data
+	}
+	src, err := decodeImage(stripped)
+	if err != nil {
+		return data
+	}
+	oriented, err := encodeJPEG(orientImage(src, orientation), defaultJPEGQuality)
+	if err != nil {
+		return data
+	}
+	return oriented
+}
+
+// stripJPEGExif elimina los segmentos APP1 Exif del JPEG y devuelve la orientación que
+// indicaban (0 si no había). ok es false si la estructura del JPEG no es válida.
+func stripJPEGExif(data []byte) (stripped []byte, orientation int, ok bool) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	found := false
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, 0, false
+		}
+		marker := data[pos+1]
+		// A partir del inicio del scan ya no hay más cabeceras
+		if marker == 0xDA {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, false
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			found = true
+			if o := exifOrientation(segment[6:]); o != 0 {
+				orientation = o
+			}
+		} else {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	if !found {
+		return data, 0, true
+	}
+	return append(out, data[pos:]...), orientation, true
+}
+
+// exifOrientation lee la etiqueta Orientation del IFD0 de una cabecera TIFF.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientImage aplica a src la transformación de la orientación EXIF (2-8).
+func orientImage(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // espejo horizontal
+				dx, dy = w-1-x, y
+			case 3: // 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // espejo vertical
+				dx, dy = x, h-1-y
+			case 5: // transpuesta
+				dx, dy = y, x
+			case 6: // 90° en sentido horario
+				dx, dy = h-1-y, x
+			case 7: // transversa
+				dx, dy = h-1-y, w-1-x
+			case 8: // 90° en sentido antihorario
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], rgba.Pix[rgba.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// Hosts permitidos en image_url (IMAGE_URL_ALLOWED_HOSTS). Vacío = cualquier host público.
+	imageURLAllowedHosts []string
+
+	// Tamaño máximo de la imagen descargada y tiempo máximo de la descarga
+	maxImageURLBytes int64 = 20 << 20
+	imageURLTimeout        = 10 * time.Second
+)
+
+const maxImageURLRedirects = 3
+
+// imageURLError es un fallo al obtener la imagen de image_url: URL no permitida,
+// error de red, respuesta distinta de 200 o imagen demasiado grande.
+type imageURLError struct {
+	msg string
+}
+
+func (e *imageURLError) Error() string {
+	return "image_url: " + e.msg
+}
+
+// errMultipleImageSources se devuelve cuando la imagen llega por más de una vía.
+var errMultipleImageSources = errors.New("provide only one of image_base64, image_url, image_upload_id or an uploaded image file")
+
+// imageURLClient no sigue redirecciones a hosts no permitidos y solo conecta con IPs
+// públicas. La comprobación se hace al conectar, no al resolver la URL, para que un DNS
+// que cambia de respuesta entre ambos momentos no permita llegar a la red interna.
+var imageURLClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageURLRedirects {
+			return errors.New("too many redirects")
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+// carrierGradeNAT (100.64.0.0/10) no es privado para net.IP, pero algunos proveedores
+// cloud lo usan para servicios internos y de metadatos.
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || carrierGradeNAT.Contains(ip) {
+		return fmt.Errorf("address %s is not allowed", host)
+	}
+	return nil
+}
+
+// checkImageURL admite solo http/https y, si hay lista de hosts, solo esos hosts.
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https URLs are allowed")
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if len(imageURLAllowedHosts) > 0 && !slices.Contains(imageURLAllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("host %s is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// fetchImage descarga la imagen de rawURL con los límites de tamaño y tiempo configurados.
+func fetchImage(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &imageURLError{"invalid URL"}
+	}
+	if err := checkImageURL(u); err != nil {
+		return nil, &imageURLError{err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, imageURLTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &imageURLError{"invalid URL"}
+	}
+	// El detalle del error de red solo va al log: podría revelar la red interna
+	resp, err := imageURLClient.Do(req)
+	if err != nil {
+		logf(ctx, "Error fetching image_url: %v", err)
+		return nil, &imageURLError{"could not fetch the image"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &imageURLError{fmt.Sprintf("fetch failed with status %s", resp.Status)}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageURLBytes+1))
+	if err != nil {
+		return nil, &imageURLError{"could not fetch the image"}
+	}
+	if int64(len(data)) > maxImageURLBytes {
+		return nil, &imageURLError{fmt.Sprintf("image is larger than %d MB", maxImageURLBytes>>20)}
+	}
+	return data, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// generationDefaults son los valores por petición que un gateway de confianza puede
+// inyectar con la cabecera X-Generation-Config (JSON codificado en base64).
+type generationDefaults struct {
+	Model string `json:"model,omitempty"`
+	Size  string `json:"size,omitempty"`
+	Style string `json:"style,omitempty"`
+}
+
+type generationDefaultsContextKey struct{}
+
+const maxStyleLength = 200
+
+var modelNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// gatewayConfig aplica X-Generation-Config. Solo se acepta junto a una X-Admin-Key
+// válida: un cliente final nunca debe poder cambiar el modelo o el tamaño por esta vía.
+func gatewayConfig(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Generation-Config")
+		if header == "" {
+			next(w, r)
+			return
+		}
+
+		adminKey := r.Header.Get("X-Admin-Key")
+		if adminAPIKey == "" || subtle.ConstantTimeCompare([]byte(adminKey), []byte(adminAPIKey)) != 1 {
+			writeError(w, codeForbidden, "X-Generation-Config requires a valid X-Admin-Key", http.StatusForbidden)
+			return
+		}
+
+		defaults, err := parseGenerationDefaults(header)
+		if err != nil {
+			writeError(w, codeInvalidHeader, fmt.Sprintf("invalid X-Generation-Config: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), generationDefaultsContextKey{}, defaults)))
+	}
+}
+
+func parseGenerationDefaults(header string) (generationDefaults, error) {
+	var defaults generationDefaults
+
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return defaults, fmt.Errorf("invalid base64")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&defaults); err != nil {
+		return defaults, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	if defaults.Model != "" && !modelNamePattern.MatchString(defaults.Model) {
+		return defaults, fmt.Errorf("invalid model name")
+	}
+	if defaults.Size != "" && !validImageSize(defaults.Size) {
+		return defaults, fmt.Errorf("size must be 1K, 2K or 4K")
+	}
+	defaults.Style = strings.TrimSpace(defaults.Style)
+	if len(defaults.Style) > maxStyleLength {
+		return defaults, fmt.Errorf("style must be at most %d characters", maxStyleLength)
+	}
+	return defaults, nil
+}
+
+func generationDefaultsFromContext(ctx context.Context) generationDefaults {
+	defaults, _ := ctx.Value(generationDefaultsContextKey{}).(generationDefaults)
+	return defaults
+}
+
+// modelFor devuelve el modelo a usar en la petición.
+func modelFor(ctx context.Context) string {
+	if model := generationDefaultsFromContext(ctx).Model; model != "" {
+		return model
+	}
+	return modelName
+}
+
+// Modelos que un cliente puede pedir en el campo "model" del body (ALLOWED_MODELS). Sin
+// lista el campo solo admite el modelo por defecto.
+var allowedModels []string
+
+// checkModel valida el campo "model" del body. A diferencia del modelo de
+// X-Generation-Config, lo envía el cliente final, así que solo se aceptan los modelos
+// permitidos.
+func checkModel(model string) error {
+	if model == "" || model == modelName || slices.Contains(allowedModels, model) {
+		return nil
+	}
+	if len(allowedModels) == 0 {
+		return fmt.Errorf("model override is not enabled on this server")
+	}
+	return fmt.Errorf("model must be one of %s", strings.Join(append([]string{modelName}, allowedModels...), ", "))
+}
+
+// withModel fija el modelo pedido en el body, que tiene prioridad sobre el del gateway.
+func withModel(ctx context.Context, model string) context.Context {
+	if model == "" {
+		return ctx
+	}
+	defaults := generationDefaultsFromContext(ctx)
+	defaults.Model = model
+	return context.WithValue(ctx, generationDefaultsContextKey{}, defaults)
+}
+
+// imageSizeFor devuelve el tamaño de imagen a pedir al modelo.
+func imageSizeFor(ctx context.Context) string {
+	if size := generationDefaultsFromContext(ctx).Size; size != "" {
+		return size
+	}
+	return "1K"
+}
+
+// withImageSize fija el tamaño pedido en el body, que tiene prioridad sobre el del gateway.
+func withImageSize(ctx context.Context, size string) context.Context {
+	if size == "" {
+		return ctx
+	}
+	defaults := generationDefaultsFromContext(ctx)
+	defaults.Size = size
+	return context.WithValue(ctx, generationDefaultsContextKey{}, defaults)
+}
+
+func validImageSize(size string) bool {
+	switch size {
+	case "1K", "2K", "4K":
+		return true
+	}
+	return false
+}
+
+// withStyle añade al prompt el estilo inyectado por el gateway, si lo hay.
+func withStyle(ctx context.Context, prompt string) string {
+	if style := generationDefaultsFromContext(ctx).Style; style != "" {
+		return fmt.Sprintf("%s Style: %s.", prompt, style)
+	}
+	return prompt
+}
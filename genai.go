@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/auth/credentials"
+	"google.golang.org/genai"
+)
+
+// Backends de Google GenAI que se pueden elegir con GENAI_BACKEND
+const (
+	backendGemini = "gemini"
+	backendVertex = "vertex"
+)
+
+// newGenAIClientConfig traduce la configuración del servidor a la del cliente de genai.
+// Con Gemini API se autentica con GOOGLE_API_KEY; con Vertex AI, con el fichero de
+// GENAI_CREDENTIALS_FILE o, si no se indica, con Application Default Credentials.
+func newGenAIClientConfig(cfg *Config) (*genai.ClientConfig, error) {
+	cc := &genai.ClientConfig{
+		HTTPOptions: genai.HTTPOptions{
+			BaseURL:    cfg.GenAIBaseURL,
+			APIVersion: cfg.GenAIAPIVersion,
+		},
+	}
+
+	if cfg.GenAIBackend != backendVertex {
+		cc.Backend = genai.BackendGeminiAPI
+		cc.APIKey = cfg.GoogleAPIKey
+		return cc, nil
+	}
+
+	cc.Backend = genai.BackendVertexAI
+	cc.Project = cfg.GoogleCloudProject
+	cc.Location = cfg.GoogleCloudLocation
+	// Sin proyecto, Vertex AI se usa en modo express con la API key
+	if cc.Project == "" {
+		cc.APIKey = cfg.GoogleAPIKey
+	}
+	if cfg.GenAICredentialsFile != "" {
+		creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+			CredentialsFile: cfg.GenAICredentialsFile,
+			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GENAI_CREDENTIALS_FILE: %w", err)
+		}
+		cc.Credentials = creds
+	}
+	return cc, nil
+}
+
+// genAIBackendDescription resume el backend configurado para el log de arranque.
+func genAIBackendDescription(cc *genai.ClientConfig) string {
+	description := "Gemini API"
+	if cc.Backend == genai.BackendVertexAI {
+		description = "Vertex AI"
+		if cc.Project != "" {
+			description += fmt.Sprintf(" (project %s, location %s)", cc.Project, cc.Location)
+		} else {
+			description += " (express mode)"
+		}
+	}
+	if cc.HTTPOptions.BaseURL != "" {
+		description += " at " + cc.HTTPOptions.BaseURL
+	}
+	return description
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"iter"
+
+	"google.golang.org/genai"
+)
+
+// ImageGenerator es el acceso al modelo. Generate devuelve una imagen a partir del prompt
+// y de las imágenes de entrada, y lo usan los handlers que editan o generan una sola
+// imagen. GenerateStream devuelve el stream de respuestas en bruto para los que leen algo
+// más (texto, historias, varios candidatos). Se puede sustituir por un generador falso en
+// los tests.
+type ImageGenerator interface {
+	Generate(ctx context.Context, prompt string, images []inputImage) ([]byte, string, error)
+	GenerateStream(ctx context.Context, contents []*genai.Content, config *genai.GenerateContentConfig) iter.Seq2[*genai.GenerateContentResponse, error]
+}
+
+// imageGenerator es el generador que usan los handlers; main lo inicializa con el
+// cliente de genai. Nil = servicio no listo.
+var imageGenerator ImageGenerator
+
+// genaiGenerator es el ImageGenerator real: llama al modelo con el cliente de genai.
+type genaiGenerator struct {
+	client *genai.Client
+}
+
+func (g *genaiGenerator) Generate(ctx context.Context, prompt string, images []inputImage) ([]byte, string, error) {
+	return generateFromStream(ctx, g, prompt, images)
+}
+
+func (g *genaiGenerator) GenerateStream(ctx context.Context, contents []*genai.Content, config *genai.GenerateContentConfig) iter.Seq2[*genai.GenerateContentResponse, error] {
+	return g.client.Models.GenerateContentStream(ctx, modelFor(ctx), contents, config)
+}
+
+// generateFromStream implementa Generate sobre el GenerateStream de gen: envía cada
+// imagen de entrada en su propio genai.Part, seguidas del prompt, y lee la imagen del
+// stream.
+func generateFromStream(ctx context.Context, gen ImageGenerator, prompt string, images []inputImage) ([]byte, string, error) {
+	var parts []*genai.Part
+	for _, img := range images {
+		parts = append(parts, &genai.Part{
+			InlineData: &genai.Blob{
+				MIMEType: img.MIMEType,
+				Data:     img.Data,
+			},
+		})
+	}
+	parts = append(parts, genai.NewPartFromText(prompt))
+
+	contents := []*genai.Content{
+		{
+			Role:  "user",
+			Parts: parts,
+		},
+	}
+
+	config := newGenerationConfig(ctx, imageModalities(ctx)...)
+
+	return readCheckedImageStream(ctx, gen, prompt, contents, config)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// decodeImage decodifica los bytes de una imagen en cualquiera de los formatos registrados.
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	return img, nil
+}
+
+// checkImageDimensions lee solo la cabecera de la imagen y rechaza las que superan
+// maxDimension en ancho o alto. Los formatos que no sabemos decodificar no se comprueban.
+func checkImageDimensions(data []byte, maxDimension int) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid image: %v", err)
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return &imageTooLargeError{Width: config.Width, Height: config.Height, Max: maxDimension}
+	}
+	return nil
+}
+
+type imageTooLargeError struct {
+	Width, Height, Max int
+}
+
+func (e *imageTooLargeError) Error() string {
+	return fmt.Sprintf("image is %dx%d pixels. Maximum dimension: %d", e.Width, e.Height, e.Max)
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Calidad JPEG usada al volver a codificar si no se pide otra
+const defaultJPEGQuality = 90
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("encode jpeg: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseHexColor interpreta un color "#rrggbb" o "#rgb" (la almohadilla es opcional).
+// Vacío equivale a blanco.
+func parseHexColor(value string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(value, "#")
+	if hex == "" {
+		return color.RGBA{255, 255, 255, 255}, nil
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not a hex color like #ffffff", value)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}, nil
+}
+
+// flattenImage compone la imagen sobre un fondo sólido. Las imágenes opacas se devuelven
+// tal cual.
+func flattenImage(img image.Image, bg color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// encodeImage codifica la imagen en JPEG si mimeType lo pide y en PNG en cualquier otro caso.
+func encodeImage(img image.Image, mimeType string) ([]byte, string, error) {
+	if mimeType == "image/jpeg" {
+		data, err := encodeJPEG(img, defaultJPEGQuality)
+		return data, "image/jpeg", err
+	}
+	data, err := encodePNG(img)
+	return data, "image/png", err
+}
+
+// optimizeEncoding vuelve a codificar la imagen en cada formato candidato y devuelve la
+// versión más pequeña, incluida la original. JPEG se descarta si la imagen tiene transparencia.
+func optimizeEncoding(data []byte, mimeType string, formats []string, jpegQuality int) ([]byte, string, map[string]int, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	best, bestMime := data, mimeType
+	sizes := map[string]int{"original": len(data)}
+	for _, format := range formats {
+		var buf bytes.Buffer
+		var candidateMime string
+		switch format {
+		case "png":
+			if err := png.Encode(&buf, img); err != nil {
+				return nil, "", nil, fmt.Errorf("encode png: %w", err)
+			}
+			candidateMime = "image/png"
+		case "jpeg":
+			if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+				continue
+			}
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+				return nil, "", nil, fmt.Errorf("encode jpeg: %w", err)
+			}
+			candidateMime = "image/jpeg"
+		default:
+			continue
+		}
+
+		sizes[format] = buf.Len()
+		if buf.Len() < len(best) {
+			best, bestMime = buf.Bytes(), candidateMime
+		}
+	}
+	return best, bestMime, sizes, nil
+}
+
+// makeLQIP genera un placeholder diminuto: la imagen reducida a lqipSize píxeles en su
+// lado mayor y cuantizada a lqipColors colores, codificada como PNG con paleta. El
+// cliente la amplía (y por tanto la difumina) mientras carga la imagen completa.
+func makeLQIP(data []byte) ([]byte, error) {
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), lqipSize, lqipSize)
+	small := scaleImage(src, width, height)
+
+	colors := make([]color.RGBA, 0, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			colors = append(colors, small.RGBAAt(x, y))
+		}
+	}
+	palette := medianCut(colors, lqipColors)
+
+	paletted := image.NewPaletted(small.Bounds(), make(color.Palette, len(palette)))
+	for i, c := range palette {
+		paletted.Palette[i] = c
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			paletted.SetColorIndex(x, y, uint8(nearestColor(palette, small.RGBAAt(x, y))))
+		}
+	}
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	var buf bytes.Buffer
+	if err := encoder.Encode(&buf, paletted); err != nil {
+		return nil, fmt.Errorf("encode lqip: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	lqipSize   = 16
+	lqipColors = 16
+)
+
+// fitWithin devuelve las dimensiones máximas que caben en maxW x maxH manteniendo
+// la relación de aspecto. Un límite de 0 significa sin límite en ese eje.
+func fitWithin(width, height, maxW, maxH int) (int, int) {
+	ratio := 1.0
+	if maxW > 0 && width > maxW {
+		ratio = float64(maxW) / float64(width)
+	}
+	if maxH > 0 && height > maxH {
+		if r := float64(maxH) / float64(height); r < ratio {
+			ratio = r
+		}
+	}
+	w := max(1, int(float64(width)*ratio))
+	h := max(1, int(float64(height)*ratio))
+	return w, h
+}
+
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+// capOutputResolution reduce la imagen si supera maxOutputWidth/maxOutputHeight.
+// Devuelve false si no fue necesario reducirla.
+func capOutputResolution(data []byte, mimeType string) ([]byte, string, bool, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false, fmt.Errorf("decode image config: %w", err)
+	}
+
+	width, height := fitWithin(cfg.Width, cfg.Height, maxOutputWidth, maxOutputHeight)
+	if width == cfg.Width && height == cfg.Height {
+		return data, mimeType, false, nil
+	}
+
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	out, outMime, err := encodeImage(scaleImage(src, width, height), mimeType)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return out, outMime, true, nil
+}
+
+// fitToDimensions escala la imagen a exactamente width x height si no tiene ya ese tamaño.
+func fitToDimensions(data []byte, mimeType string, width, height int) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode image config: %w", err)
+	}
+	if cfg.Width == width && cfg.Height == height {
+		return data, mimeType, nil
+	}
+	src, err := decodeImage(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return encodeImage(scaleImage(src, width, height), mimeType)
+}
+
+type imageTile struct {
+	Column      int    `json:"column"`
+	Row         int    `json:"row"`
+	X           int    `json:"x"`
+	Y           int    `json:"y"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ImageBase64 string `json:"image_base64"`
+}
+
+// splitTiles recorta la imagen en teselas PNG de tileSize x tileSize, por filas.
+func splitTiles(src image.Image, tileSize int) ([]imageTile, error) {
+	bounds := src.Bounds()
+	var tiles []imageTile
+	for row, y := 0, bounds.Min.Y; y < bounds.Max.Y; row, y = row+1, y+tileSize {
+		for col, x := 0, bounds.Min.X; x < bounds.Max.X; col, x = col+1, x+tileSize {
+			rect := image.Rect(x, y, x+tileSize, y+tileSize).Intersect(bounds)
+			tile := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+			draw.Draw(tile, tile.Bounds(), src, rect.Min, draw.Src)
+
+			data, err := encodePNG(tile)
+			if err != nil {
+				return nil, err
+			}
+			tiles = append(tiles, imageTile{
+				Column:      col,
+				Row:         row,
+				X:           x - bounds.Min.X,
+				Y:           y - bounds.Min.Y,
+				Width:       rect.Dx(),
+				Height:      rect.Dy(),
+				ImageBase64: base64.StdEncoding.EncodeToString(data),
+			})
+		}
+	}
+	return tiles, nil
+}
+
+// imageEntropy calcula la entropía de Shannon (en bits, de 0 a 8) del histograma de
+// luminancia. Una imagen de un solo color tiene entropía 0.
+func imageEntropy(img image.Image) float64 {
+	var histogram [256]int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			histogram[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+		}
+	}
+
+	total := float64(bounds.Dx() * bounds.Dy())
+	if total == 0 {
+		return 0
+	}
+	entropy := 0.0
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// compositeLayers superpone las capas en orden sobre un lienzo del tamaño de la primera.
+func compositeLayers(layers []image.Image) *image.RGBA {
+	bounds := layers[0].Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for _, layer := range layers {
+		draw.Draw(dst, dst.Bounds(), layer, layer.Bounds().Min, draw.Over)
+	}
+	return dst
+}
+
+// pixelate reduce la imagen a bloques de blockSize píxeles y cuantiza sus colores
+// a una paleta de como máximo paletteSize colores usando median-cut.
+func pixelate(src image.Image, blockSize, paletteSize int) *image.RGBA {
+	bounds := src.Bounds()
+	cols := (bounds.Dx() + blockSize - 1) / blockSize
+	rows := (bounds.Dy() + blockSize - 1) / blockSize
+
+	blocks := make([]color.RGBA, cols*rows)
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			rect := image.Rect(
+				bounds.Min.X+bx*blockSize,
+				bounds.Min.Y+by*blockSize,
+				bounds.Min.X+(bx+1)*blockSize,
+				bounds.Min.Y+(by+1)*blockSize,
+			).Intersect(bounds)
+			blocks[by*cols+bx] = averageColor(src, rect)
+		}
+	}
+
+	palette := medianCut(blocks, paletteSize)
+
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			c := palette[nearestColor(palette, blocks[by*cols+bx])]
+			for y := by * blockSize; y < (by+1)*blockSize && y < bounds.Dy(); y++ {
+				for x := bx * blockSize; x < (bx+1)*blockSize && x < bounds.Dx(); x++ {
+					dst.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func averageColor(src image.Image, rect image.Rectangle) color.RGBA {
+	var r, g, b, a, n uint64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+			r += uint64(c.R)
+			g += uint64(c.G)
+			b += uint64(c.B)
+			a += uint64(c.A)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)}
+}
+
+// medianCut divide recursivamente el conjunto de colores por la mediana del canal
+// con mayor rango hasta obtener n cajas, y devuelve el color medio de cada caja.
+func medianCut(colors []color.RGBA, n int) []color.RGBA {
+	boxes := [][]color.RGBA{append([]color.RGBA(nil), colors...)}
+
+	for len(boxes) < n {
+		idx, channel, best := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			ch, rng := widestChannel(box)
+			if rng > best {
+				idx, channel, best = i, ch, rng
+			}
+		}
+		if idx < 0 {
+			break
+		}
+
+		box := boxes[idx]
+		sort.SliceStable(box, func(i, j int) bool {
+			return channelValue(box[i], channel) < channelValue(box[j], channel)
+		})
+		mid := len(box) / 2
+		boxes[idx] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	palette := make([]color.RGBA, 0, len(boxes))
+	for _, box := range boxes {
+		palette = append(palette, meanColor(box))
+	}
+	return palette
+}
+
+func widestChannel(box []color.RGBA) (int, int) {
+	channel, best := 0, -1
+	for ch := 0; ch < 3; ch++ {
+		lo, hi := 255, 0
+		for _, c := range box {
+			v := channelValue(c, ch)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > best {
+			channel, best = ch, hi-lo
+		}
+	}
+	return channel, best
+}
+
+func channelValue(c color.RGBA, channel int) int {
+	switch channel {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	default:
+		return int(c.B)
+	}
+}
+
+func meanColor(box []color.RGBA) color.RGBA {
+	var r, g, b, a uint64
+	for _, c := range box {
+		r += uint64(c.R)
+		g += uint64(c.G)
+		b += uint64(c.B)
+		a += uint64(c.A)
+	}
+	n := uint64(len(box))
+	if n == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)}
+}
+
+func nearestColor(palette []color.RGBA, c color.RGBA) int {
+	best, bestDist := 0, -1
+	for i, p := range palette {
+		dr := int(p.R) - int(c.R)
+		dg := int(p.G) - int(c.G)
+		db := int(p.B) - int(c.B)
+		da := int(p.A) - int(c.A)
+		dist := dr*dr + dg*dg + db*db + da*da
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
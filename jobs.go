@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobStore guarda en memoria el estado de los trabajos asíncronos para consultarlo en
+// /jobs/{id}. Los terminados caducan pasado ttl; los que siguen en marcha no.
+type jobStore struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	jobs map[string]*jobEntry
+}
+
+type jobEntry struct {
+	result  asyncResult
+	expires time.Time     // cero mientras el trabajo no termina
+	done    chan struct{} // se cierra al terminar, para el long-polling
+}
+
+const (
+	jobStatusPending = "pending"
+	jobStatusRunning = "running"
+)
+
+// Espera máxima de ?wait= en /jobs/{id}
+const maxJobWait = 60 * time.Second
+
+var asyncJobStore = newJobStore(time.Hour)
+
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{ttl: ttl, jobs: make(map[string]*jobEntry)}
+}
+
+// create registra un trabajo pendiente y de paso descarta los caducados.
+func (s *jobStore) create(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for jobID, entry := range s.jobs {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(s.jobs, jobID)
+		}
+	}
+	s.jobs[id] = &jobEntry{result: asyncResult{JobID: id, Status: jobStatusPending}, done: make(chan struct{})}
+}
+
+func (s *jobStore) setRunning(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.jobs[id]; ok {
+		entry.result.Status = jobStatusRunning
+	}
+}
+
+// finish guarda el resultado final, despierta a quien espera el trabajo y empieza a
+// contar su caducidad.
+func (s *jobStore) finish(result *asyncResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.jobs[result.JobID]
+	if !ok {
+		entry = &jobEntry{done: make(chan struct{})}
+		s.jobs[result.JobID] = entry
+	}
+	entry.result = *result
+	entry.expires = time.Now().Add(s.ttl)
+	close(entry.done)
+}
+
+// get devuelve el estado del trabajo y un canal que se cierra cuando termina.
+func (s *jobStore) get(id string) (asyncResult, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.jobs[id]
+	if !ok {
+		return asyncResult{}, nil, false
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(s.jobs, id)
+		return asyncResult{}, nil, false
+	}
+	return entry.result, entry.done, true
+}
+
+// handleJob devuelve el estado de un trabajo asíncrono. Como las URLs de /images/, el ID
+// aleatorio hace de credencial, así que consultar no consume llamadas de la API key.
+// Con ?wait=N, si el trabajo no ha terminado, espera hasta N segundos a que termine.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, codeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxJobWait {
+			writeError(w, codeInvalidParameter, fmt.Sprintf("wait must be a number of seconds between 0 and %d", int(maxJobWait.Seconds())), http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	result, done, ok := asyncJobStore.get(id)
+	if !ok {
+		writeError(w, codeNotFound, "job not found", http.StatusNotFound)
+		return
+	}
+	if wait > 0 && result.Status != jobStatusDone && result.Status != jobStatusFailed {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		// Termine, venza la espera o venza el plazo de la petición, se responde con el estado
+		// actual: durante la espera el trabajo ha podido pasar de pending a running
+		select {
+		case <-done:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		// Ha podido caducar justo después de terminar si JOB_TTL_SECONDS es muy corto
+		if result, _, ok = asyncJobStore.get(id); !ok {
+			writeError(w, codeNotFound, "job not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
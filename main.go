@@ -1,26 +1,100 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"io"
 	"log"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
 	"google.golang.org/genai"
 )
 
 var (
-	aiClient    *genai.Client
 	modelName   = "gemini-3-pro-image-preview"
 	maxBodySize int64
 	apiKeys     = make(map[string]*apiKeyInfo)
 	keysMutex   sync.RWMutex
+	adminAPIKey string
+
+	// Límite más estricto para los endpoints que envían la imagen al modelo
+	maxEditBodySize int64
+
+	maxOutputWidth  int
+	maxOutputHeight int
+
+	// Ancho o alto máximo de las imágenes de entrada
+	maxImageDimension = 4096
+
+	altTextEnabled bool
+
+	lqipEnabled bool
+
+	optimizeFormats     = []string{"png", "jpeg"}
+	optimizeJPEGQuality = 80
+
+	entropyCheckEnabled bool
+	minImageEntropy     = 0.5
+	entropyCheckRetries = 1
+
+	// nil cuando no hay carriles de prioridad configurados
+	scheduler *laneScheduler
+
+	// Semáforo global de llamadas simultáneas a genai; nil si no hay límite
+	generationSlots chan struct{}
+
+	// nil cuando PACER_RPM no está configurado
+	generationPacer *pacer
+
+	// nil cuando RATE_LIMIT_RPM no está configurado
+	requestLimiter *rateLimiter
+
+	// Longitud máxima en caracteres de los prompts (MAX_PROMPT_LENGTH) y qué hacer con
+	// los que la superan (PROMPT_LENGTH_POLICY)
+	maxPromptLength    = 4000
+	promptLengthPolicy = promptLengthReject
+
+	// nil cuando CACHE_MAX_ENTRIES no está configurado
+	generationCache *imageCache
+
+	safetySoftenEnabled bool
+	softenPatterns      []*regexp.Regexp
+
+	// Plazo máximo de cada petición, muy por debajo del timeout de 30 minutos del servidor
+	generationTimeout = 120 * time.Second
+)
+
+type debugContextKey struct{}
+
+type altTextContextKey struct{}
+
+type apiKeyContextKey struct{}
+
+const (
+	altTextInstruction = "Also reply with a single short sentence describing the resulting image, suitable as alt text."
+	maxAltTextLength   = 250
 )
 
 type apiKeyInfo struct {
@@ -31,350 +105,3292 @@ type apiKeyInfo struct {
 }
 
 type TextToImageRequest struct {
-	Prompt string `json:"prompt"`
+	commonImageOptions
+
+	Prompt         string          `json:"prompt"`
+	NegativePrompt string          `json:"negative_prompt,omitempty"`
+	Size           string          `json:"size,omitempty"`
+	AspectRatio    string          `json:"aspect_ratio,omitempty"`
+	Seed           *int32          `json:"seed,omitempty"`
+	Temperature    *float32        `json:"temperature,omitempty"`
+	TopP           *float32        `json:"top_p,omitempty"`
+	TileSize       int             `json:"tile_size,omitempty"`
+	CallbackURL    string          `json:"callback_url,omitempty"`
+	Async          bool            `json:"async,omitempty"`
+	CandidateCount int32           `json:"candidate_count,omitempty"`
+	Watermark      watermarkOption `json:"watermark,omitempty"`
+	Preview        bool            `json:"preview,omitempty"`
+	Upgrade        bool            `json:"upgrade,omitempty"`
+}
+
+const (
+	maxNegativePromptLength = 500
+	maxCandidateCount       = 4
+)
+
+// Políticas de PROMPT_LENGTH_POLICY para los textos que superan MAX_PROMPT_LENGTH
+const (
+	promptLengthReject   = "reject"
+	promptLengthTruncate = "truncate"
+)
+
+var promptLengthPolicies = []string{promptLengthReject, promptLengthTruncate}
+
+// checkPromptLength aplica PROMPT_LENGTH_POLICY a los textos que superan MAX_PROMPT_LENGTH
+// caracteres, que el modelo no aceptaría o truncaría: con reject devuelve un error y con
+// truncate recorta *prompt al límite y lo indica en la cabecera X-Prompt-Truncated.
+func checkPromptLength(ctx context.Context, w http.ResponseWriter, field string, prompt *string) error {
+	n := utf8.RuneCountInString(*prompt)
+	if n <= maxPromptLength {
+		return nil
+	}
+	if promptLengthPolicy != promptLengthTruncate {
+		return fmt.Errorf("%s is %d characters long. Maximum length: %d", field, n, maxPromptLength)
+	}
+
+	*prompt = string([]rune(*prompt)[:maxPromptLength])
+	w.Header().Add("X-Prompt-Truncated", field)
+	logf(ctx, "Truncated %s from %d to %d characters", field, n, maxPromptLength)
+	return nil
 }
 
 type ResizeRequest struct {
-	ImageBase64 string `json:"image_base64"`
-	Scale       int    `json:"scale"`
+	ImageBase64   string  `json:"image_base64"`
+	ImageURL      string  `json:"image_url,omitempty"`
+	ImageUploadID string  `json:"image_upload_id,omitempty"`
+	Scale         float64 `json:"scale"`
+	Mode          string  `json:"mode,omitempty"`
+	commonImageOptions
 }
 
+// Rango admitido para el factor de escalado de /resize
+const (
+	minResizeScale = 1.5
+	maxResizeScale = 8.0
+)
+
+// Plantilla de prompt de cada modo de /resize
+var resizeModes = map[string]string{
+	"upscale": "resize",
+	"enhance": "resize-enhance",
+	"denoise": "resize-denoise",
+}
+
+type UpscaleRequest struct {
+	ImageBase64   string  `json:"image_base64"`
+	ImageURL      string  `json:"image_url,omitempty"`
+	ImageUploadID string  `json:"image_upload_id,omitempty"`
+	Scale         float64 `json:"scale,omitempty"`
+	commonImageOptions
+}
+
+const (
+	defaultUpscaleScale = 2.0
+	// Lado mayor del tamaño 4K, el máximo que genera el modelo
+	maxUpscaleDimension = 4096
+)
+
 type SketchToImageRequest struct {
-	ImageBase64 string `json:"image_base64"`
-	Description string `json:"description"`
+	ImageBase64   string   `json:"image_base64"`
+	ImageURL      string   `json:"image_url,omitempty"`
+	ImageUploadID string   `json:"image_upload_id,omitempty"`
+	Sketches      []string `json:"sketches,omitempty"`
+	Description   string   `json:"description"`
+	commonImageOptions
 }
 
+const maxSketchLayers = 8
+
 type MagicEraserRequest struct {
+	ImageBase64   string `json:"image_base64"`
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageUploadID string `json:"image_upload_id,omitempty"`
+	commonImageOptions
+}
+
+type ColorizeRequest struct {
+	ImageBase64   string `json:"image_base64"`
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageUploadID string `json:"image_upload_id,omitempty"`
+	commonImageOptions
+}
+
+type GenerateRequest struct {
+	commonImageOptions
+
+	Prompt        string          `json:"prompt"`
+	ImageBase64   string          `json:"image_base64,omitempty"`
+	ImageURL      string          `json:"image_url,omitempty"`
+	ImageUploadID string          `json:"image_upload_id,omitempty"`
+	Watermark     watermarkOption `json:"watermark,omitempty"`
+}
+
+type StoryRequest struct {
+	Prompt string `json:"prompt"`
+	generationOptions
+}
+
+type storySegment struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	MIMEType    string `json:"mime_type,omitempty"`
+	ImageBase64 string `json:"image_base64,omitempty"`
+}
+
+const (
+	maxStoryParts = 32
+	maxStoryBytes = 50 * 1024 * 1024
+)
+
+type VariationsRequest struct {
+	generationOptions
+
+	Prompt    string          `json:"prompt"`
+	Count     int             `json:"count,omitempty"`
+	Watermark watermarkOption `json:"watermark,omitempty"`
+}
+
+const (
+	defaultVariations = 4
+	maxVariations     = 8
+)
+
+type variationImage struct {
+	ImageBase64 string `json:"image_base64"`
+	MIMEType    string `json:"mime_type"`
+}
+
+type BatchRequest struct {
+	generationOptions
+
+	Prompts   []string        `json:"prompts"`
+	Size      string          `json:"size,omitempty"`
+	Watermark watermarkOption `json:"watermark,omitempty"`
+}
+
+// Límites de /batch: prompts por petición y generaciones simultáneas de un mismo batch
+const (
+	maxBatchPrompts     = 16
+	maxBatchConcurrency = 4
+)
+
+// batchResult es el resultado de un prompt del batch: la imagen o el error, nunca ambos.
+type batchResult struct {
+	Prompt      string `json:"prompt"`
+	ImageBase64 string `json:"image_base64,omitempty"`
+	MIMEType    string `json:"mime_type,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+type ExtendRequest struct {
+	ImageBase64   string `json:"image_base64"`
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageUploadID string `json:"image_upload_id,omitempty"`
+	Direction     string `json:"direction"`
+	Amount        int    `json:"amount"`
+	commonImageOptions
+}
+
+const maxExtendAmount = 1024
+
+// Descripción en el prompt de cada dirección de /extend
+var extendDirections = map[string]string{
+	"top":    "upwards, above the top edge",
+	"bottom": "downwards, below the bottom edge",
+	"left":   "to the left of the left edge",
+	"right":  "to the right of the right edge",
+}
+
+type InpaintRequest struct {
+	ImageBase64   string `json:"image_base64"`
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageUploadID string `json:"image_upload_id,omitempty"`
+	MaskBase64    string `json:"mask_base64"`
+	Prompt        string `json:"prompt,omitempty"`
+	commonImageOptions
+}
+
+type StyleTransferRequest struct {
+	ContentBase64 string `json:"content_base64"`
+	StyleBase64   string `json:"style_base64"`
+	commonImageOptions
+}
+
+type ReplaceSubjectRequest struct {
+	BaseBase64      string `json:"base_base64"`
+	ReferenceBase64 string `json:"reference_base64"`
+	Prompt          string `json:"prompt"`
+	commonImageOptions
+}
+
+type CombineRequest struct {
+	ImagesBase64 []string `json:"images_base64"`
+	Prompt       string   `json:"prompt"`
+	commonImageOptions
+}
+
+const maxCombineImages = 4
+
+type DescribeRequest struct {
+	ImageBase64   string `json:"image_base64"`
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageUploadID string `json:"image_upload_id,omitempty"`
+	generationOptions
+}
+
+type ThumbnailRequest struct {
+	ImageBase64 string `json:"image_base64"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+}
+
+const maxThumbnailSize = 2048
+
+type PixelateRequest struct {
 	ImageBase64 string `json:"image_base64"`
+	BlockSize   int    `json:"block_size"`
+	PaletteSize int    `json:"palette_size"`
+}
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: No se pudo cargar el archivo .env: %v", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("config error:\n%v", err)
+	}
+
+	ctx := context.Background()
+
+	clientConfig, err := newGenAIClientConfig(cfg)
+	if err != nil {
+		log.Fatalf("client error: %v", err)
+	}
+	client, err := genai.NewClient(ctx, clientConfig)
+	if err != nil {
+		log.Fatalf("client error: %v", err)
+	}
+
+	imageGenerator = &genaiGenerator{client: client}
+	log.Printf("Backend de Google GenAI: %s", genAIBackendDescription(clientConfig))
+
+	modelName = cfg.Model
+	log.Printf("Modelo activo: %s", modelName)
+
+	// Modelos que se pueden pedir por petición con el campo "model"
+	allowedModels = cfg.AllowedModels
+	// Sondeo opcional de los modelos: ajusta ALLOWED_MODELS y la temperatura máxima
+	if cfg.ModelProbeEnabled {
+		lookup := func(ctx context.Context, model string) (*genai.Model, error) {
+			return client.Models.Get(ctx, model, nil)
+		}
+		probedModels, allowedModels = probeModels(ctx, lookup, modelName, allowedModels)
+	}
+	if len(allowedModels) > 0 {
+		log.Printf("Per-request model override enabled: %s", strings.Join(allowedModels, ", "))
+	}
+
+	// El SDK de genai necesita la imagen completa en memoria (Blob.Data es []byte) y la vuelve
+	// a serializar en base64, así que no se puede hacer streaming: se limita el tamaño en su lugar
+	maxBodySize = cfg.MaxBodySize
+	maxEditBodySize = cfg.MaxEditBodySize
+
+	maxPromptLength = cfg.MaxPromptLength
+	promptLengthPolicy = cfg.PromptLengthPolicy
+	for _, host := range cfg.ImageURLAllowedHosts {
+		imageURLAllowedHosts = append(imageURLAllowedHosts, strings.ToLower(host))
+	}
+	maxImageURLBytes = cfg.ImageURLMaxSize
+	imageURLTimeout = cfg.ImageURLTimeout
+	maxImageDimension = cfg.MaxImageDimension
+	// Resolución máxima de salida (0 = sin límite)
+	maxOutputWidth = cfg.MaxOutputWidth
+	maxOutputHeight = cfg.MaxOutputHeight
+
+	// Reintento con prompt suavizado tras un bloqueo de seguridad (cambia la intención del usuario, desactivado por defecto)
+	safetySoftenEnabled = cfg.SafetySoftenEnabled
+	for _, term := range cfg.SafetySoftenTerms {
+		softenPatterns = append(softenPatterns, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(term)+`\b`))
+	}
+
+	// Carriles de prioridad: se activan si se configura el tamaño de alguno
+	if cfg.LaneSizeHigh > 0 || cfg.LaneSizeNormal > 0 || cfg.LaneSizeLow > 0 {
+		laneHigh, laneNormal, laneLow := max(cfg.LaneSizeHigh, 1), max(cfg.LaneSizeNormal, 1), max(cfg.LaneSizeLow, 1)
+		scheduler = newLaneScheduler(laneHigh, laneNormal, laneLow)
+		log.Printf("Priority lanes enabled (high: %d, normal: %d, low: %d)", laneHigh, laneNormal, laneLow)
+	}
+
+	if cfg.MaxConcurrentGenerations > 0 {
+		generationSlots = make(chan struct{}, cfg.MaxConcurrentGenerations)
+		log.Printf("Concurrent generations limited to %d", cfg.MaxConcurrentGenerations)
+	}
+
+	// Ritmo adaptativo de llamadas a genai
+	if cfg.PacerRPM > 0 {
+		generationPacer = newPacer(cfg.PacerRPM)
+		log.Printf("Adaptive pacing enabled (%.1f RPM)", cfg.PacerRPM)
+	}
+
+	// Límite de peticiones por cliente (API key o IP)
+	if cfg.RateLimitRPM > 0 {
+		requestLimiter = newRateLimiter(cfg.RateLimitRPM)
+		log.Printf("Rate limiting enabled (%.1f RPM per client)", cfg.RateLimitRPM)
+	}
+
+	// Caché de imágenes generadas a partir de solo texto
+	if cfg.CacheMaxEntries > 0 {
+		generationCache = newImageCache(cfg.CacheMaxEntries, cfg.CacheTTL)
+		log.Printf("Image cache enabled (%d entries, TTL %s)", cfg.CacheMaxEntries, cfg.CacheTTL)
+	}
+
+	// Reintentos de errores transitorios de Google GenAI (5xx, 429)
+	retryMaxAttempts = cfg.RetryMaxAttempts
+	retryBaseDelay = cfg.RetryBaseDelay
+
+	// Formatos candidatos para optimize=true (no hay codificador WebP en Go puro)
+	optimizeFormats = cfg.OptimizeFormats
+	optimizeJPEGQuality = cfg.OptimizeJPEGQuality
+
+	// Detección de imágenes en blanco (requiere decodificar cada imagen generada)
+	entropyCheckEnabled = cfg.EntropyCheckEnabled
+	minImageEntropy = cfg.MinImageEntropy
+	entropyCheckRetries = cfg.EntropyCheckRetries
+
+	// Placeholder de baja calidad para carga progresiva
+	lqipEnabled = cfg.LQIPEnabled
+
+	// Alt text generado por el modelo (añade latencia y coste)
+	altTextEnabled = cfg.AltTextEnabled
+
+	generationTimeout = cfg.GenerationTimeout
+
+	// Sin ADMIN_API_KEY la cabecera X-Debug se ignora siempre
+	adminAPIKey = cfg.AdminAPIKey
+
+	allowedOrigins = cfg.AllowedOrigins
+	if len(allowedOrigins) > 0 {
+		log.Printf("CORS enabled for origins: %s", strings.Join(allowedOrigins, ", "))
+	}
+
+	storageURLTTL = cfg.StorageURLTTL
+	if cfg.StorageBackend != "" {
+		store, err := newImageStore(cfg.StorageBackend)
+		if err != nil {
+			log.Fatalf("storage error: %v", err)
+		}
+		imageStorage = store
+		storageKeyStrategy = cfg.StorageKeyStrategy
+		log.Printf("Storing generated images in %s backend (%s keys)", cfg.StorageBackend, cfg.StorageKeyStrategy)
+	}
+
+	// Instrucciones enviadas al modelo, personalizables sin recompilar
+	if err := loadPromptTemplates(); err != nil {
+		log.Fatalf("prompt templates error: %v", err)
+	}
+
+	// Modo asíncrono con callback_url: sin clave no se pueden firmar los callbacks
+	callbackSecret = cfg.CallbackSecret
+	if callbackSecret != "" {
+		log.Println("Async generation with callback_url enabled")
+	}
+	asyncJobStore.ttl = cfg.JobTTL
+
+	// Subidas por partes (image_upload_id)
+	chunkedUploads.dir = cfg.UploadDir
+	chunkedUploads.ttl = cfg.UploadTTL
+	chunkedUploads.maxSize = cfg.MaxUploadSize
+	chunkedUploads.quota = cfg.UploadQuota
+	if err := chunkedUploads.init(); err != nil {
+		log.Fatalf("upload dir error: %v", err)
+	}
+	go chunkedUploads.expireLoop()
+
+	// Moderación local de prompts antes de llamar al modelo
+	if err := loadPromptBlocklist(cfg.PromptBlocklist, cfg.PromptBlocklistFile); err != nil {
+		log.Fatalf("prompt blocklist error: %v", err)
+	}
+
+	// Marca de agua opcional por petición (campo watermark)
+	watermarkText = cfg.WatermarkText
+	watermarkPosition = cfg.WatermarkPosition
+	watermarkOpacity = cfg.WatermarkOpacity
+	if cfg.WatermarkImage != "" {
+		logo, err := loadWatermarkLogo(cfg.WatermarkImage)
+		if err != nil {
+			log.Fatalf("watermark error: %v", err)
+		}
+		watermarkLogo = logo
+	}
+
+	// Cargar las 20 API keys predefinidas
+	loadPredefinedAPIKeys()
+
+	log.Println("=== API Keys cargadas ===")
+	keysMutex.RLock()
+	for key := range apiKeys {
+		log.Printf("API Key: %s (Límite: %d llamadas)", key, apiKeys[key].Limit)
+	}
+	keysMutex.RUnlock()
+	log.Printf("Total de API Keys: %d", len(apiKeys))
+	log.Println("===========================")
+
+	// Crear mux con middleware
+	mux := http.NewServeMux()
+	mux.HandleFunc("/text-to-image", limitBodySize(rateLimit(validateAPIKey(handleTextToImage))))
+	mux.HandleFunc("/resize", limitEditBodySize(rateLimit(validateAPIKey(handleResize))))
+	mux.HandleFunc("/upscale", limitEditBodySize(rateLimit(validateAPIKey(handleUpscale))))
+	mux.HandleFunc("/sketch-to-image", limitEditBodySize(rateLimit(validateAPIKey(handleSketchToImage))))
+	mux.HandleFunc("/magic-eraser", limitEditBodySize(rateLimit(validateAPIKey(handleMagicEraser))))
+	mux.HandleFunc("/colorize", limitEditBodySize(rateLimit(validateAPIKey(handleColorize))))
+	mux.HandleFunc("/generate", limitEditBodySize(rateLimit(validateAPIKey(handleGenerate))))
+	mux.HandleFunc("/inpaint", limitEditBodySize(rateLimit(validateAPIKey(handleInpaint))))
+	mux.HandleFunc("/style-transfer", limitEditBodySize(rateLimit(validateAPIKey(handleStyleTransfer))))
+	mux.HandleFunc("/combine", limitEditBodySize(rateLimit(validateAPIKey(handleCombine))))
+	mux.HandleFunc("/replace-subject", limitEditBodySize(rateLimit(validateAPIKey(handleReplaceSubject))))
+	mux.HandleFunc("/extend", limitEditBodySize(rateLimit(validateAPIKey(handleExtend))))
+	mux.HandleFunc("/story", limitBodySize(rateLimit(validateAPIKey(handleStory))))
+	mux.HandleFunc("/describe", limitEditBodySize(rateLimit(validateAPIKey(handleDescribe))))
+	mux.HandleFunc("/variations", limitBodySize(rateLimit(validateAPIKey(handleVariations))))
+	mux.HandleFunc("/batch", limitBodySize(rateLimit(validateAPIKey(handleBatch))))
+	mux.HandleFunc("/jobs/", handleJob)
+	mux.HandleFunc("/uploads", limitBodySize(rateLimit(requireAPIKey(handleCreateUpload))))
+	mux.HandleFunc("/uploads/", rateLimit(requireAPIKey(handleUpload)))
+	mux.HandleFunc("/pixelate", limitBodySize(validateAPIKey(handlePixelate)))
+	mux.HandleFunc("/thumbnail", limitBodySize(validateAPIKey(handleThumbnail)))
+	mux.HandleFunc("/api-keys", handleListAPIKeys)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+	if store, ok := imageStorage.(*localStore); ok {
+		mux.Handle("/images/", storedImagesHandler(store))
+	}
+	mux.HandleFunc("/", handleNotFound)
+
+	// Warm-up opcional antes de aceptar tráfico (main no se ejecuta en los tests)
+	if cfg.WarmUpEnabled {
+		warmUp(ctx, cfg.WarmUpPrompt)
+	}
+
+	port := cfg.Port
+
+	server := &http.Server{
+		Addr:           ":" + port,
+		Handler:        withRequestID(accessLog(withMetrics(mux, withRecovery(cors(debugOverride(gatewayConfig(withAltText(withUsage(withSafetyRatings(withTimeout(mux.ServeHTTP))))))))))),
+		ReadTimeout:    30 * 60 * 1000000000, // 30 minutos
+		WriteTimeout:   30 * 60 * 1000000000, // 30 minutos
+		MaxHeaderBytes: 10 << 20,             // 10MB para headers
+	}
+
+	// Plazo para que terminen las peticiones en curso al apagar; por defecto el de una generación
+	shutdownTimeout := cfg.ShutdownTimeout
+
+	stop, cancelSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancelSignals()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("API listening on :%s (Max body size: %d MB, image edits: %d MB, timeout: %s)", port, maxBodySize/(1024*1024), maxEditBodySize/(1024*1024), generationTimeout)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		log.Fatalf("server error: %v", err)
+	case <-stop.Done():
+	}
+
+	log.Printf("Shutdown signal received, draining in-flight requests (timeout: %s)", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v", err)
+		return
+	}
+
+	// Los trabajos asíncronos siguen en marcha aunque ya no haya peticiones abiertas
+	jobsDone := make(chan struct{})
+	go func() {
+		asyncJobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		log.Println("Shutdown did not complete cleanly: async jobs still running")
+		return
+	}
+	log.Println("Shutdown complete")
+}
+
+const (
+	defaultWarmUpPrompt = "A plain white square."
+	warmUpTimeout       = 2 * time.Minute
+)
+
+// warmUp lanza una generación mínima para inicializar conexiones antes de la primera
+// petición real. Un fallo solo se registra: el servidor arranca igualmente.
+func warmUp(ctx context.Context, prompt string) {
+	ctx, cancel := context.WithTimeout(ctx, warmUpTimeout)
+	defer cancel()
+
+	log.Printf("Warm-up: generating %q", prompt)
+	start := time.Now()
+	if _, _, err := generateImageWithInput(ctx, prompt, nil, ""); err != nil {
+		log.Printf("Warm-up failed after %s: %v", time.Since(start), err)
+		return
+	}
+	log.Printf("Warm-up completed in %s", time.Since(start))
+}
+
+func handleTextToImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req TextToImageRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+	if len(req.NegativePrompt) > maxNegativePromptLength {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("negative_prompt must be at most %d characters", maxNegativePromptLength), http.StatusBadRequest)
+		return
+	}
+	if req.Size != "" && !validImageSize(req.Size) {
+		writeError(w, codeInvalidParameter, "size must be 1K, 2K or 4K", http.StatusBadRequest)
+		return
+	}
+	if req.AspectRatio != "" && !validAspectRatio(req.AspectRatio) {
+		writeError(w, codeInvalidParameter, "aspect_ratio must be one of "+strings.Join(aspectRatios, ", "), http.StatusBadRequest)
+		return
+	}
+	// Sin sondeo de modelos el límite es fijo; con él, el que informa el modelo de la petición
+	maxTemperature := maxTemperatureFor(cmp.Or(req.Model, modelFor(r.Context())))
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxTemperature) {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("temperature must be between 0 and %g", maxTemperature), http.StatusBadRequest)
+		return
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		writeError(w, codeInvalidParameter, "top_p must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	if req.TileSize != 0 && (req.TileSize < 64 || req.TileSize > 2048) {
+		writeError(w, codeInvalidParameter, "tile_size must be between 64 and 2048", http.StatusBadRequest)
+		return
+	}
+	if req.TileSize != 0 && req.OutputFormat != "" {
+		writeError(w, codeInvalidParameter, "output_format cannot be combined with tile_size", http.StatusBadRequest)
+		return
+	}
+	stream := acceptsEventStream(r)
+	// Con SSE las cabeceras se envían al empezar el stream, así que no hay dónde informar
+	// de X-Optimize-Format y X-Optimize-Sizes
+	if stream && (req.TileSize != 0 || req.Optimize) {
+		writeError(w, codeInvalidParameter, "tile_size and optimize are not supported with text/event-stream", http.StatusBadRequest)
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := checkCallbackURL(req.CallbackURL); err != nil {
+			writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// callback_url implica el modo asíncrono; async sin callback es para consultar /jobs/{id}
+	async := req.Async || req.CallbackURL != ""
+	if async && (stream || req.TileSize != 0) {
+		writeError(w, codeInvalidParameter, "async and callback_url cannot be combined with tile_size or text/event-stream", http.StatusBadRequest)
+		return
+	}
+	if req.CandidateCount < 0 || req.CandidateCount > maxCandidateCount {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("candidate_count must be between 1 and %d", maxCandidateCount), http.StatusBadRequest)
+		return
+	}
+	multiCandidate := req.CandidateCount > 1
+	if multiCandidate && (stream || async || req.TileSize != 0 || req.Optimize) {
+		writeError(w, codeInvalidParameter, "candidate_count cannot be combined with tile_size, optimize, async or text/event-stream", http.StatusBadRequest)
+		return
+	}
+	if req.Preview && (req.Upgrade || multiCandidate || async || stream) {
+		writeError(w, codeInvalidParameter, "preview cannot be combined with upgrade, candidate_count, async or text/event-stream", http.StatusBadRequest)
+		return
+	}
+	if req.Upgrade && req.Seed == nil {
+		writeError(w, codeInvalidParameter, "upgrade requires the seed returned with the preview", http.StatusBadRequest)
+		return
+	}
+	if err := req.Watermark.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+	// Cada candidato consume una llamada de la key, como las imágenes de /variations
+	if multiCandidate && !reserveAPIKeyCalls(w, r, int(req.CandidateCount)-1) {
+		return
+	}
+
+	// La previsualización siempre lleva semilla para poder pedir después la versión final
+	if req.Preview && req.Seed == nil {
+		req.Seed = randomSeed()
+	}
+
+	r = withStoragePrompt(r, req.Prompt)
+	ctx := withImageSize(withModel(withPriority(r.Context(), req.Priority), req.Model), req.Size)
+	ctx = withGenerationParams(ctx, generationParams{
+		Seed:           req.Seed,
+		Temperature:    req.Temperature,
+		TopP:           req.TopP,
+		AspectRatio:    req.AspectRatio,
+		CandidateCount: req.CandidateCount,
+		Preview:        req.Preview,
+	})
+
+	// Gemini no tiene un parámetro de negative prompt: se añade al prompt como instrucción
+	prompt := req.Prompt
+	if negative := strings.TrimSpace(req.NegativePrompt); negative != "" {
+		prompt = renderPrompt(ctx, "negative-prompt", promptData{Prompt: prompt, NegativePrompt: negative})
+	}
+
+	if stream {
+		streamTextToImage(ctx, w, prompt, req)
+		return
+	}
+	if multiCandidate {
+		writeCandidates(ctx, w, prompt, req)
+		return
+	}
+	if async {
+		jobID := startAsyncJob(ctx, req.CallbackURL, func(ctx context.Context) *asyncResult {
+			return textToImageJob(ctx, prompt, req)
+		})
+		statusURL := "/jobs/" + jobID
+		w.Header().Set("Location", statusURL)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": jobID, "status": jobStatusPending, "status_url": statusURL})
+		return
+	}
+
+	imgBytes, mimeType, usedPrompt, cached, err := generateCached(ctx, "/text-to-image", prompt)
+	if err != nil {
+		logf(ctx, "Error generating image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("generation error: %v", err), err)
+		return
+	}
+
+	setCacheHeader(w, cached)
+	setSoftenedPromptHeaders(w, prompt, usedPrompt)
+	if req.Seed != nil {
+		w.Header().Set("X-Seed", fmt.Sprintf("%d", *req.Seed))
+	}
+	if req.Preview {
+		w.Header().Set("X-Preview", "true")
+	}
+	if req.TileSize > 0 {
+		imgBytes, mimeType, err = applyWatermark(imgBytes, mimeType, req.Watermark)
+		if err != nil {
+			logf(ctx, "Error applying watermark: %v", err)
+			writeError(w, codeInternalError, fmt.Sprintf("watermark error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeTiles(ctx, w, imgBytes, mimeType, req.TileSize)
+		return
+	}
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, req.Watermark)
+}
+
+// streamTextToImage responde /text-to-image como Server-Sent Events: un evento "text" o
+// "thought" por cada parte de texto del stream y un evento final "image" o "error".
+// Las cabeceras ya se han enviado al empezar, así que el alt text no se pide.
+func streamTextToImage(ctx context.Context, w http.ResponseWriter, prompt string, req TextToImageRequest) {
+	sse := newSSEWriter(w)
+	ctx = context.WithValue(ctx, altTextContextKey{}, (*strings.Builder)(nil))
+	ctx = withProgress(ctx, func(kind, text string) {
+		sse.event(kind, map[string]string{"text": text})
+	})
+
+	imgBytes, mimeType, _, err := generateWithSoftening(ctx, prompt)
+	if err == nil {
+		imgBytes, mimeType, err = applyWatermark(imgBytes, mimeType, req.Watermark)
+	}
+	var downscaled bool
+	if err == nil {
+		imgBytes, mimeType, downscaled = capOutput(ctx, imgBytes, mimeType)
+		imgBytes, mimeType, err = convertOutput(imgBytes, mimeType, req.OutputFormat, req.OutputQuality, req.BackgroundColor)
+	}
+	if err != nil {
+		logf(ctx, "Error generating image: %v", err)
+		sse.event("error", map[string]string{
+			"error": fmt.Sprintf("generation error: %v", err),
+			"code":  generationErrorCode(err),
+		})
+		return
+	}
+
+	event := map[string]any{
+		"image_base64": base64.StdEncoding.EncodeToString(imgBytes),
+		"mime_type":    mimeType,
+	}
+	if req.Seed != nil {
+		event["seed"] = *req.Seed
+	}
+	if downscaled {
+		event["downscaled"] = true
+	}
+	sse.event("image", addUsage(ctx, event))
+}
+
+// writeCandidates responde /text-to-image con candidate_count > 1 con todas las imágenes
+// en el mismo formato que /variations. Como allí, el alt text no se pide.
+func writeCandidates(ctx context.Context, w http.ResponseWriter, prompt string, req TextToImageRequest) {
+	ctx = context.WithValue(ctx, altTextContextKey{}, (*strings.Builder)(nil))
+	candidates, err := generateCandidates(ctx, prompt)
+	if err != nil {
+		logf(ctx, "Error generating candidates: %v", err)
+		refundAPIKeyCalls(ctx, int(req.CandidateCount)-1)
+		writeGenerationError(w, fmt.Sprintf("generation error: %v", err), err)
+		return
+	}
+	// Se devuelven las llamadas de los candidatos descartados; la petición cuesta al menos una
+	refundAPIKeyCalls(ctx, int(req.CandidateCount)-max(len(candidates), 1))
+
+	images := make([]variationImage, 0, len(candidates))
+	for _, candidate := range candidates {
+		img, mimeType, err := applyWatermark(candidate.Data, candidate.MIMEType, req.Watermark)
+		if err != nil {
+			logf(ctx, "Error applying watermark: %v", err)
+			writeError(w, codeInternalError, fmt.Sprintf("watermark error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		img, mimeType = applyOutputCap(ctx, w, img, mimeType)
+		img, mimeType, err = convertOutput(img, mimeType, req.OutputFormat, req.OutputQuality, req.BackgroundColor)
+		if err != nil {
+			logf(ctx, "Error converting output: %v", err)
+			writeError(w, codeInternalError, fmt.Sprintf("output conversion error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		images = append(images, variationImage{
+			ImageBase64: base64.StdEncoding.EncodeToString(img),
+			MIMEType:    mimeType,
+		})
+	}
+
+	if req.Seed != nil {
+		w.Header().Set("X-Seed", fmt.Sprintf("%d", *req.Seed))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"images":    images,
+		"requested": req.CandidateCount,
+		"partial":   len(images) < int(req.CandidateCount),
+	}))
+}
+
+// textToImageJob es la generación de /text-to-image en modo asíncrono (async o callback_url).
+func textToImageJob(ctx context.Context, prompt string, req TextToImageRequest) *asyncResult {
+	imgBytes, mimeType, _, _, err := generateCached(ctx, "/text-to-image", prompt)
+	if err != nil {
+		logf(ctx, "Error generating image: %v", err)
+		return failedJobResult(fmt.Sprintf("generation error: %v", err), err)
+	}
+	imgBytes, mimeType, err = applyWatermark(imgBytes, mimeType, req.Watermark)
+	if err != nil {
+		logf(ctx, "Error applying watermark: %v", err)
+		return &asyncResult{Status: jobStatusFailed, Error: fmt.Sprintf("watermark error: %v", err), Code: codeInternalError}
+	}
+	if req.Optimize {
+		if best, bestMime, _, err := optimizeEncoding(imgBytes, mimeType, optimizeFormats, optimizeJPEGQuality); err != nil {
+			logf(ctx, "Error optimizing output encoding: %v", err)
+		} else {
+			imgBytes, mimeType = best, bestMime
+		}
+	}
+	imgBytes, mimeType, err = convertOutput(imgBytes, mimeType, req.OutputFormat, req.OutputQuality, req.BackgroundColor)
+	if err != nil {
+		logf(ctx, "Error converting output: %v", err)
+		return &asyncResult{Status: jobStatusFailed, Error: fmt.Sprintf("output conversion error: %v", err), Code: codeInternalError}
+	}
+	result := imageJobResult(ctx, imgBytes, mimeType)
+	result.Seed = req.Seed
+	return result
+}
+
+func handleResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req ResizeRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+	if req.Scale < minResizeScale || req.Scale > maxResizeScale {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("scale must be between %g and %g", minResizeScale, maxResizeScale), http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "upscale"
+	}
+	promptTemplate, ok := resizeModes[req.Mode]
+	if !ok {
+		writeError(w, codeInvalidParameter, "mode must be upscale, enhance or denoise", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt := renderPrompt(r.Context(), promptTemplate, promptData{Scale: req.Scale})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error resizing image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("resize error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+// handleUpscale amplía una foto con instrucciones de superresolución. A diferencia de
+// /resize, pide al modelo el tamaño (1K, 2K o 4K) que cubre el resultado y ajusta la
+// imagen devuelta a las dimensiones exactas de la original por scale.
+func handleUpscale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req UpscaleRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+	if req.Scale == 0 {
+		req.Scale = defaultUpscaleScale
+	}
+	if req.Scale < minResizeScale || req.Scale > maxResizeScale {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("scale must be between %g and %g", minResizeScale, maxResizeScale), http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		writeError(w, codeInvalidImage, fmt.Sprintf("invalid image: %v", err), http.StatusBadRequest)
+		return
+	}
+	width := int(float64(config.Width)*req.Scale + 0.5)
+	height := int(float64(config.Height)*req.Scale + 0.5)
+	if width > maxUpscaleDimension || height > maxUpscaleDimension {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("upscaled image would be %dx%d pixels. Maximum dimension: %d", width, height, maxUpscaleDimension), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withImageSize(withModel(withPriority(r.Context(), req.Priority), req.Model), upscaleImageSize(width, height))
+	prompt := renderPrompt(ctx, "upscale", promptData{Scale: req.Scale, Width: width, Height: height})
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error upscaling image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("upscale error: %v", err), err)
+		return
+	}
+
+	imgBytes, mimeType, err = fitToDimensions(imgBytes, mimeType, width, height)
+	if err != nil {
+		logf(ctx, "Error scaling upscaled image: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("upscale error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+// upscaleImageSize devuelve el menor tamaño de generación cuyo lado mayor cubre el resultado.
+func upscaleImageSize(width, height int) string {
+	switch side := max(width, height); {
+	case side <= 1024:
+		return "1K"
+	case side <= 2048:
+		return "2K"
+	default:
+		return "4K"
+	}
+}
+
+func handleSketchToImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req SketchToImageRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	hasImage := imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	req.Description = strings.TrimSpace(req.Description)
+	if (!hasImage && len(req.Sketches) == 0) || req.Description == "" {
+		writeError(w, codeMissingFields, "missing fields", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "description", &req.Description); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Description); term != "" {
+		writePromptRejected(r.Context(), w, "description", term)
+		return
+	}
+	if hasImage && len(req.Sketches) > 0 {
+		writeError(w, codeInvalidParameter, "provide either image_base64 or sketches, not both", http.StatusBadRequest)
+		return
+	}
+	if len(req.Sketches) > maxSketchLayers {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("too many sketches. Maximum: %d", maxSketchLayers), http.StatusBadRequest)
+		return
+	}
+
+	var imgData []byte
+	if hasImage {
+		imgData, err = requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+		if err != nil {
+			writeImageSourceError(w, err, "invalid base64")
+			return
+		}
+		if inputType := detectImageMIMEType(imgData); !supportedInputType(inputType) {
+			writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+			writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Las capas se combinan en orden en una sola imagen antes de enviarla al modelo
+		layers := make([]image.Image, 0, len(req.Sketches))
+		for i, sketch := range req.Sketches {
+			data, err := decodeBase64Image(sketch)
+			if err != nil {
+				writeError(w, codeInvalidBase64, fmt.Sprintf("invalid base64 in sketches[%d]", i), http.StatusBadRequest)
+				return
+			}
+			if inputType := detectImageMIMEType(data); !supportedInputType(inputType) {
+				writeError(w, codeUnsupportedMediaType, fmt.Sprintf("sketches[%d]: %s", i, unsupportedInputTypeMessage(inputType)), http.StatusUnsupportedMediaType)
+				return
+			}
+			data = autoOrient(data)
+			if err := checkImageDimensions(data, maxImageDimension); err != nil {
+				writeError(w, imageErrorCode(err), fmt.Sprintf("sketches[%d]: %v", i, err), http.StatusBadRequest)
+				return
+			}
+			layer, err := decodeImage(data)
+			if err != nil {
+				writeError(w, codeInvalidImage, fmt.Sprintf("invalid image in sketches[%d]", i), http.StatusBadRequest)
+				return
+			}
+			layers = append(layers, layer)
+		}
+
+		imgData, err = encodePNG(compositeLayers(layers))
+		if err != nil {
+			logf(r.Context(), "Error compositing sketches: %v", err)
+			writeError(w, codeInternalError, fmt.Sprintf("sketch error: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	prompt := renderPrompt(r.Context(), "sketch-to-image", promptData{Description: req.Description})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	r = withStoragePrompt(r, req.Description)
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, imgData, detectImageMIMEType(imgData))
+	if err != nil {
+		logf(ctx, "Error converting sketch to image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("sketch error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+func handleMagicEraser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req MagicEraserRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt := renderPrompt(r.Context(), "magic-eraser", promptData{})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error with magic eraser: %v", err)
+		writeGenerationError(w, fmt.Sprintf("eraser error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+func handleColorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req ColorizeRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithInput(ctx, renderPrompt(ctx, "colorize", promptData{}), imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error colorizing image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("colorize error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+func handleInpaint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req InpaintRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) || !imageProvided(uploads, "mask", req.MaskBase64, "", "") {
+		writeError(w, codeMissingImage, "image and mask are required", http.StatusBadRequest)
+		return
+	}
+
+	images := make([]inputImage, 0, 2)
+	for _, field := range []struct{ name, upload, value, url, uploadID string }{
+		{"image_base64", "image", req.ImageBase64, req.ImageURL, req.ImageUploadID},
+		{"mask_base64", "mask", req.MaskBase64, "", ""},
+	} {
+		data, err := requestImage(r.Context(), uploads, field.upload, field.value, field.url, field.uploadID)
+		if err != nil {
+			writeImageSourceError(w, err, fmt.Sprintf("invalid base64 in %s", field.name))
+			return
+		}
+		inputType := detectImageMIMEType(data)
+		if !supportedInputType(inputType) {
+			writeError(w, codeUnsupportedMediaType, fmt.Sprintf("%s: %s", field.name, unsupportedInputTypeMessage(inputType)), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkImageDimensions(data, maxImageDimension); err != nil {
+			writeError(w, imageErrorCode(err), fmt.Sprintf("%s: %v", field.name, err), http.StatusBadRequest)
+			return
+		}
+		images = append(images, inputImage{Data: data, MIMEType: inputType})
+	}
+
+	// Sin prompt se elimina lo que cubre la máscara, como hace /magic-eraser
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+	prompt := renderPrompt(r.Context(), "inpaint", promptData{Prompt: req.Prompt})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	r = withStoragePrompt(r, req.Prompt)
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithImages(ctx, prompt, images)
+	if err != nil {
+		logf(ctx, "Error inpainting image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("inpaint error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+func handleStyleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req StyleTransferRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if (req.ContentBase64 == "" && uploads["content"] == nil) || (req.StyleBase64 == "" && uploads["style"] == nil) {
+		writeError(w, codeMissingImage, "content and style images are required", http.StatusBadRequest)
+		return
+	}
+
+	images := make([]inputImage, 0, 2)
+	for _, field := range []struct{ name, upload, value string }{
+		{"content_base64", "content", req.ContentBase64},
+		{"style_base64", "style", req.StyleBase64},
+	} {
+		data, err := uploadedImage(uploads, field.upload, field.value)
+		if err != nil {
+			writeError(w, codeInvalidBase64, fmt.Sprintf("invalid base64 in %s", field.name), http.StatusBadRequest)
+			return
+		}
+		inputType := detectImageMIMEType(data)
+		if !supportedInputType(inputType) {
+			writeError(w, codeUnsupportedMediaType, fmt.Sprintf("%s: %s", field.name, unsupportedInputTypeMessage(inputType)), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkImageDimensions(data, maxImageDimension); err != nil {
+			writeError(w, imageErrorCode(err), fmt.Sprintf("%s: %v", field.name, err), http.StatusBadRequest)
+			return
+		}
+		images = append(images, inputImage{Data: data, MIMEType: inputType})
+	}
+
+	prompt := renderPrompt(r.Context(), "style-transfer", promptData{})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithImages(ctx, prompt, images)
+	if err != nil {
+		logf(ctx, "Error transferring style: %v", err)
+		writeGenerationError(w, fmt.Sprintf("style transfer error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+// handleReplaceSubject sustituye un sujeto de la imagen base por el de la imagen de
+// referencia. El prompt indica qué sujeto se reemplaza y cómo.
+func handleReplaceSubject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req ReplaceSubjectRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if (req.BaseBase64 == "" && uploads["base"] == nil) || (req.ReferenceBase64 == "" && uploads["reference"] == nil) {
+		writeError(w, codeMissingImage, "base and reference images are required", http.StatusBadRequest)
+		return
+	}
+	// Sin prompt el modelo no sabe qué sujeto cambiar y suele devolver la base sin tocar
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt: describe which subject to replace, e.g. \"replace the dog with the cat from the reference\"", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+
+	images := make([]inputImage, 0, 2)
+	for _, field := range []struct{ name, upload, value string }{
+		{"base_base64", "base", req.BaseBase64},
+		{"reference_base64", "reference", req.ReferenceBase64},
+	} {
+		data, err := uploadedImage(uploads, field.upload, field.value)
+		if err != nil {
+			writeError(w, codeInvalidBase64, fmt.Sprintf("invalid base64 in %s", field.name), http.StatusBadRequest)
+			return
+		}
+		inputType := detectImageMIMEType(data)
+		if !supportedInputType(inputType) {
+			writeError(w, codeUnsupportedMediaType, fmt.Sprintf("%s: %s", field.name, unsupportedInputTypeMessage(inputType)), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkImageDimensions(data, maxImageDimension); err != nil {
+			writeError(w, imageErrorCode(err), fmt.Sprintf("%s: %v", field.name, err), http.StatusBadRequest)
+			return
+		}
+		images = append(images, inputImage{Data: data, MIMEType: inputType})
+	}
+
+	prompt := renderPrompt(r.Context(), "replace-subject", promptData{Prompt: strings.TrimSuffix(req.Prompt, ".")})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	r = withStoragePrompt(r, req.Prompt)
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithImages(ctx, prompt, images)
+	if err != nil {
+		logf(ctx, "Error replacing subject: %v", err)
+		writeGenerationError(w, fmt.Sprintf("replace subject error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+// handleCombine genera una imagen a partir de varias imágenes de referencia, enviadas
+// en orden como partes independientes antes del prompt.
+func handleCombine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req CombineRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.ImagesBase64) == 0 {
+		writeError(w, codeMissingImage, "missing images", http.StatusBadRequest)
+		return
+	}
+	if len(req.ImagesBase64) > maxCombineImages {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("at most %d images can be combined", maxCombineImages), http.StatusBadRequest)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+
+	images := make([]inputImage, 0, len(req.ImagesBase64))
+	for i, b64 := range req.ImagesBase64 {
+		data, err := decodeBase64Image(b64)
+		if err != nil || len(data) == 0 {
+			writeError(w, codeInvalidBase64, fmt.Sprintf("invalid base64 in images_base64[%d]", i), http.StatusBadRequest)
+			return
+		}
+		data = autoOrient(data)
+		inputType := detectImageMIMEType(data)
+		if !supportedInputType(inputType) {
+			writeError(w, codeUnsupportedMediaType, fmt.Sprintf("images_base64[%d]: %s", i, unsupportedInputTypeMessage(inputType)), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkImageDimensions(data, maxImageDimension); err != nil {
+			writeError(w, imageErrorCode(err), fmt.Sprintf("images_base64[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		images = append(images, inputImage{Data: data, MIMEType: inputType})
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	r = withStoragePrompt(r, req.Prompt)
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithImages(ctx, req.Prompt, images)
+	if err != nil {
+		logf(ctx, "Error combining images: %v", err)
+		writeGenerationError(w, fmt.Sprintf("combine error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+// handleGenerate actúa como text-to-image cuando solo llega un prompt y como
+// edición de imagen cuando además se envía image_base64.
+func handleGenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req GenerateRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+
+	if err := req.Watermark.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r = withStoragePrompt(r, req.Prompt)
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		if isDryRun(r) {
+			writeDryRun(w)
+			return
+		}
+		imgBytes, mimeType, usedPrompt, cached, err := generateCached(ctx, "/generate", req.Prompt)
+		if err != nil {
+			logf(ctx, "Error generating image: %v", err)
+			writeGenerationError(w, fmt.Sprintf("generation error: %v", err), err)
+			return
+		}
+		setCacheHeader(w, cached)
+		setSoftenedPromptHeaders(w, req.Prompt, usedPrompt)
+		writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, req.Watermark)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+	imgBytes, mimeType, err := generateImageWithInput(ctx, req.Prompt, imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error editing image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("edit error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, req.Watermark)
+}
+
+func handleExtend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req ExtendRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+	direction, ok := extendDirections[req.Direction]
+	if !ok {
+		writeError(w, codeInvalidParameter, "direction must be top, bottom, left or right", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < 1 || req.Amount > maxExtendAmount {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("amount must be between 1 and %d pixels", maxExtendAmount), http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt := renderPrompt(r.Context(), "extend", promptData{Amount: req.Amount, Direction: direction})
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, imgData, inputType)
+	if err != nil {
+		logf(ctx, "Error extending image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("extend error: %v", err), err)
+		return
+	}
+
+	writeProcessedImage(ctx, w, r, imgBytes, mimeType, req.commonImageOptions, watermarkOption{})
+}
+
+func handleStory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req StoryRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	segments, truncated, err := generateInterleaved(ctx, req.Prompt)
+	if err != nil {
+		logf(ctx, "Error generating story: %v", err)
+		writeGenerationError(w, fmt.Sprintf("story error: %v", err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"segments":  segments,
+		"truncated": truncated,
+	}))
+}
+
+func handleDescribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DescribeRequest
+	uploads, err := decodeRequest(r, &req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !imageProvided(uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID) {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := requestImage(r.Context(), uploads, "image", req.ImageBase64, req.ImageURL, req.ImageUploadID)
+	if err != nil {
+		writeImageSourceError(w, err, "invalid base64")
+		return
+	}
+	inputType := detectImageMIMEType(imgData)
+	if !supportedInputType(inputType) {
+		writeError(w, codeUnsupportedMediaType, unsupportedInputTypeMessage(inputType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	description, err := describeImage(ctx, inputImage{Data: imgData, MIMEType: inputType})
+	if err != nil {
+		logf(ctx, "Error describing image: %v", err)
+		writeGenerationError(w, fmt.Sprintf("describe error: %v", err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"description": description,
+	}))
+}
+
+func handleVariations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req VariationsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	req.Prompt = strings.TrimSpace(req.Prompt)
+	if req.Prompt == "" {
+		writeError(w, codeMissingPrompt, "missing prompt", http.StatusBadRequest)
+		return
+	}
+	if err := checkPromptLength(r.Context(), w, "prompt", &req.Prompt); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if term := blockedPromptTerm(req.Prompt); term != "" {
+		writePromptRejected(r.Context(), w, "prompt", term)
+		return
+	}
+	if req.Count == 0 {
+		req.Count = defaultVariations
+	}
+	if req.Count < 1 || req.Count > maxVariations {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("count must be between 1 and %d", maxVariations), http.StatusBadRequest)
+		return
+	}
+	if err := req.Watermark.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+	// Cada variación es una llamada al modelo y consume una llamada de la key
+	if !reserveAPIKeyCalls(w, r, req.Count-1) {
+		return
+	}
+
+	// Las generaciones van en paralelo; los carriles y el pacer siguen limitando las
+	// llamadas a genai. El alt text se desactiva porque el builder no se puede compartir.
+	ctx := withModel(withPriority(r.Context(), req.Priority), req.Model)
+	ctx = context.WithValue(ctx, altTextContextKey{}, (*strings.Builder)(nil))
+
+	images := make([][]byte, req.Count)
+	mimeTypes := make([]string, req.Count)
+	errs := make([]error, req.Count)
+	var wg sync.WaitGroup
+	for i := range req.Count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			images[i], mimeTypes[i], errs[i] = generateImageWithInput(ctx, req.Prompt, nil, "")
+		}()
+	}
+	wg.Wait()
+
+	variations := []variationImage{}
+	failures := []string{}
+	defer func() {
+		// Se devuelven las llamadas de las variaciones fallidas; la petición cuesta al menos una
+		refundAPIKeyCalls(ctx, min(len(failures), req.Count-1))
+	}()
+	var firstErr error
+	for i := range req.Count {
+		if errs[i] != nil {
+			logf(ctx, "Error generating variation %d/%d: %v", i+1, req.Count, errs[i])
+			failures = append(failures, errs[i].Error())
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		img, mimeType, err := applyWatermark(images[i], mimeTypes[i], req.Watermark)
+		if err != nil {
+			logf(ctx, "Error applying watermark: %v", err)
+			writeError(w, codeInternalError, fmt.Sprintf("watermark error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		img, mimeType = applyOutputCap(ctx, w, img, mimeType)
+		variations = append(variations, variationImage{
+			ImageBase64: base64.StdEncoding.EncodeToString(img),
+			MIMEType:    mimeType,
+		})
+	}
+
+	if len(variations) == 0 {
+		writeGenerationError(w, fmt.Sprintf("variations error: %v", firstErr), firstErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"images":    variations,
+		"requested": req.Count,
+		"partial":   len(failures) > 0,
+		"errors":    failures,
+	}))
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BatchRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Prompts) == 0 {
+		writeError(w, codeMissingPrompt, "missing prompts", http.StatusBadRequest)
+		return
+	}
+	if len(req.Prompts) > maxBatchPrompts {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("at most %d prompts per batch", maxBatchPrompts), http.StatusBadRequest)
+		return
+	}
+	for i, prompt := range req.Prompts {
+		req.Prompts[i] = strings.TrimSpace(prompt)
+		if req.Prompts[i] == "" {
+			writeError(w, codeMissingPrompt, fmt.Sprintf("prompt %d is empty", i), http.StatusBadRequest)
+			return
+		}
+		if err := checkPromptLength(r.Context(), w, fmt.Sprintf("prompt %d", i), &req.Prompts[i]); err != nil {
+			writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if term := blockedPromptTerm(req.Prompts[i]); term != "" {
+			writePromptRejected(r.Context(), w, fmt.Sprintf("prompt %d", i), term)
+			return
+		}
+	}
+	if req.Size != "" && !validImageSize(req.Size) {
+		writeError(w, codeInvalidParameter, "size must be 1K, 2K or 4K", http.StatusBadRequest)
+		return
+	}
+	if err := req.Watermark.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+	// Como en /variations, cada prompt consume una llamada de la key y se cobran antes de
+	// arrancar ningún worker
+	if !reserveAPIKeyCalls(w, r, len(req.Prompts)-1) {
+		return
+	}
+
+	// Como en /variations, el alt text se desactiva porque el builder no se puede compartir
+	ctx := withImageSize(withModel(withPriority(r.Context(), req.Priority), req.Model), req.Size)
+	ctx = context.WithValue(ctx, altTextContextKey{}, (*strings.Builder)(nil))
+
+	// Cada goroutine escribe en su posición, así la respuesta conserva el orden de entrada
+	images := make([][]byte, len(req.Prompts))
+	mimeTypes := make([]string, len(req.Prompts))
+	errs := make([]error, len(req.Prompts))
+	slots := make(chan struct{}, maxBatchConcurrency)
+	var wg sync.WaitGroup
+	for i, prompt := range req.Prompts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			images[i], mimeTypes[i], _, _, errs[i] = generateCached(ctx, "/text-to-image", prompt)
+		}()
+	}
+	wg.Wait()
+
+	results := make([]batchResult, len(req.Prompts))
+	failed, notGenerated := 0, 0
+	for i, prompt := range req.Prompts {
+		results[i].Prompt = prompt
+		if errs[i] != nil {
+			logf(ctx, "Error generating batch image %d/%d: %v", i+1, len(req.Prompts), errs[i])
+			results[i].Error = errs[i].Error()
+			results[i].Code = generationErrorCode(errs[i])
+			failed++
+			notGenerated++
+			continue
+		}
+		img, mimeType, err := applyWatermark(images[i], mimeTypes[i], req.Watermark)
+		if err != nil {
+			logf(ctx, "Error applying watermark to batch image %d/%d: %v", i+1, len(req.Prompts), err)
+			results[i].Error = fmt.Sprintf("watermark error: %v", err)
+			results[i].Code = codeInternalError
+			failed++
+			continue
+		}
+		img, mimeType = applyOutputCap(ctx, w, img, mimeType)
+		results[i].ImageBase64 = base64.StdEncoding.EncodeToString(img)
+		results[i].MIMEType = mimeType
+	}
+	refundAPIKeyCalls(ctx, min(notGenerated, len(req.Prompts)-1))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"results": results,
+		"failed":  failed,
+	}))
+}
+
+// generateInterleaved recoge en orden todas las partes de texto e imagen de la respuesta.
+// Los fragmentos de texto consecutivos se unen en un solo segmento. Si se superan
+// maxStoryParts o maxStoryBytes se deja de leer y se marca la respuesta como truncada.
+func generateInterleaved(ctx context.Context, prompt string) ([]storySegment, bool, error) {
+	prompt = withStyle(ctx, prompt)
+
+	contents := []*genai.Content{
+		{
+			Role: "user",
+			Parts: []*genai.Part{
+				genai.NewPartFromText(prompt),
+			},
+		},
+	}
+
+	config := newGenerationConfig(ctx, modalityImage, modalityText)
+
+	var segments []storySegment
+	var truncated bool
+	err := retryGeneration(ctx, func() error {
+		var err error
+		segments, truncated, err = readInterleavedStream(ctx, prompt, contents, config)
+		return err
+	})
+	return segments, truncated, err
+}
+
+// readInterleavedStream consume el stream de genai de /story.
+func readInterleavedStream(ctx context.Context, prompt string, contents []*genai.Content, config *genai.GenerateContentConfig) ([]storySegment, bool, error) {
+	done, err := startGeneration(ctx, prompt, config)
+	if err != nil {
+		return nil, false, err
+	}
+	defer done()
+
+	var segments []storySegment
+	totalBytes := 0
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { recordUsage(ctx, usage) }()
+	for result, err := range imageGenerator.GenerateStream(ctx, contents, config) {
+		if ctxErr := streamCanceled(ctx); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		if err != nil {
+			reportUpstreamError(err)
+			return nil, false, contextError(ctx, err)
+		}
+		if result.UsageMetadata != nil {
+			usage = result.UsageMetadata
+		}
+
+		if err := checkBlocked(result); err != nil {
+			return nil, false, err
+		}
+
+		if len(result.Candidates) == 0 || result.Candidates[0].Content == nil {
+			continue
+		}
+
+		for _, part := range result.Candidates[0].Content.Parts {
+			switch {
+			case part.InlineData != nil:
+				if len(segments) >= maxStoryParts || totalBytes+len(part.InlineData.Data) > maxStoryBytes {
+					return segments, true, nil
+				}
+				mimeType := generatedImageMIMEType(ctx, part.InlineData)
+				totalBytes += len(part.InlineData.Data)
+				segments = append(segments, storySegment{
+					Type:        "image",
+					MIMEType:    mimeType,
+					ImageBase64: base64.StdEncoding.EncodeToString(part.InlineData.Data),
+				})
+			case part.Text != "" && !part.Thought:
+				if totalBytes+len(part.Text) > maxStoryBytes {
+					return segments, true, nil
+				}
+				totalBytes += len(part.Text)
+				if n := len(segments); n > 0 && segments[n-1].Type == "text" {
+					segments[n-1].Text += part.Text
+					continue
+				}
+				if len(segments) >= maxStoryParts {
+					return segments, true, nil
+				}
+				segments = append(segments, storySegment{Type: "text", Text: part.Text})
+			}
+		}
+	}
+	// Al cancelarse el contexto el iterador de genai termina sin devolver error
+	if ctxErr := streamCanceled(ctx); ctxErr != nil {
+		return nil, false, ctxErr
+	}
+	if len(segments) == 0 {
+		return nil, false, fmt.Errorf("no content returned")
+	}
+	return segments, false, nil
+}
+
+func handlePixelate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req PixelateRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.ImageBase64 == "" {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+	if req.BlockSize < 1 || req.BlockSize > 256 {
+		writeError(w, codeInvalidParameter, "block_size must be between 1 and 256", http.StatusBadRequest)
+		return
+	}
+	if req.PaletteSize < 2 || req.PaletteSize > 256 {
+		writeError(w, codeInvalidParameter, "palette_size must be between 2 and 256", http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := decodeBase64Image(req.ImageBase64)
+	if err != nil {
+		writeError(w, codeInvalidBase64, "invalid base64", http.StatusBadRequest)
+		return
+	}
+	imgData = autoOrient(imgData)
+
+	src, err := decodeImage(imgData)
+	if err != nil {
+		writeError(w, codeInvalidImage, "invalid image", http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	// Efecto local: no se llama al modelo
+	imgBytes, err := encodePNG(pixelate(src, req.BlockSize, req.PaletteSize))
+	if err != nil {
+		logf(r.Context(), "Error pixelating image: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("pixelate error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeImage(w, r, imgBytes, "image/png")
+}
+
+// handleThumbnail reduce la imagen localmente para que quepa en width x height, sin
+// llamar al modelo. Nunca la amplía.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, codeMethodNotAllowed, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := responseFormat(r); !ok {
+		writeError(w, codeInvalidParameter, "format must be raw, json or datauri", http.StatusBadRequest)
+		return
+	}
+
+	var req ThumbnailRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.ImageBase64 == "" {
+		writeError(w, codeMissingImage, "missing image", http.StatusBadRequest)
+		return
+	}
+	if req.Width == 0 && req.Height == 0 {
+		writeError(w, codeMissingFields, "width or height is required", http.StatusBadRequest)
+		return
+	}
+	if req.Width < 0 || req.Width > maxThumbnailSize || req.Height < 0 || req.Height > maxThumbnailSize {
+		writeError(w, codeInvalidParameter, fmt.Sprintf("width and height must be between 1 and %d", maxThumbnailSize), http.StatusBadRequest)
+		return
+	}
+
+	imgData, err := decodeBase64Image(req.ImageBase64)
+	if err != nil {
+		writeError(w, codeInvalidBase64, "invalid base64", http.StatusBadRequest)
+		return
+	}
+	imgData = autoOrient(imgData)
+	if err := checkImageDimensions(imgData, maxImageDimension); err != nil {
+		writeError(w, imageErrorCode(err), err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	src, err := decodeImage(imgData)
+	if err != nil {
+		writeError(w, codeInvalidImage, "invalid image", http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w)
+		return
+	}
+
+	// Efecto local: no se llama al modelo. JPEG se mantiene en JPEG; el resto pasa a PNG
+	bounds := src.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), req.Width, req.Height)
+	imgBytes, mimeType, err := encodeImage(scaleImage(src, width, height), detectImageMIMEType(imgData))
+	if err != nil {
+		logf(r.Context(), "Error creating thumbnail: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("thumbnail error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeImage(w, r, imgBytes, mimeType)
+}
+
+// inputImage es una imagen de entrada que se envía al modelo como InlineData.
+type inputImage struct {
+	Data     []byte
+	MIMEType string
+}
+
+// generateImageWithInput genera la imagen con el prompt y, si imgBytes no es nil, con la
+// imagen de entrada.
+func generateImageWithInput(ctx context.Context, prompt string, imgBytes []byte, mimeType string) ([]byte, string, error) {
+	var images []inputImage
+	if imgBytes != nil {
+		images = append(images, inputImage{Data: imgBytes, MIMEType: mimeType})
+	}
+	return generateImageWithImages(ctx, prompt, images)
+}
+
+// generateImageWithImages completa el prompt (estilo e instrucción de alt text) y lo pasa
+// con las imágenes de entrada, en el orden recibido, al imageGenerator configurado.
+func generateImageWithImages(ctx context.Context, prompt string, images []inputImage) ([]byte, string, error) {
+	prompt = withAltTextInstruction(ctx, withStyle(ctx, prompt))
+	if imageGenerator == nil {
+		return nil, "", errServiceNotReady
+	}
+	return imageGenerator.Generate(ctx, prompt, images)
+}
+
+// describeImage pide al modelo solo texto sobre la imagen y devuelve la descripción.
+func describeImage(ctx context.Context, img inputImage) (string, error) {
+	prompt := renderPrompt(ctx, "describe", promptData{})
+	contents := []*genai.Content{
+		{
+			Role: "user",
+			Parts: []*genai.Part{
+				{InlineData: &genai.Blob{MIMEType: img.MIMEType, Data: img.Data}},
+				genai.NewPartFromText(prompt),
+			},
+		},
+	}
+	config := newGenerationConfig(ctx, modalityText)
+
+	var description string
+	err := retryGeneration(ctx, func() error {
+		var err error
+		description, err = readTextStream(ctx, prompt, contents, config)
+		return err
+	})
+	return description, err
+}
+
+// readTextStream consume el stream de genai y concatena las partes de texto, sin los
+// pensamientos del modelo.
+func readTextStream(ctx context.Context, prompt string, contents []*genai.Content, config *genai.GenerateContentConfig) (string, error) {
+	done, err := startGeneration(ctx, prompt, config)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	var text strings.Builder
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { recordUsage(ctx, usage) }()
+	for result, err := range imageGenerator.GenerateStream(ctx, contents, config) {
+		if ctxErr := streamCanceled(ctx); ctxErr != nil {
+			return "", ctxErr
+		}
+		if err != nil {
+			reportUpstreamError(err)
+			return "", contextError(ctx, err)
+		}
+		if result.UsageMetadata != nil {
+			usage = result.UsageMetadata
+		}
+		if err := checkBlocked(result); err != nil {
+			return "", err
+		}
+		if len(result.Candidates) == 0 || result.Candidates[0].Content == nil {
+			continue
+		}
+		for _, part := range result.Candidates[0].Content.Parts {
+			if part.Text != "" && !part.Thought {
+				text.WriteString(part.Text)
+			}
+		}
+	}
+	// Al cancelarse el contexto el iterador de genai termina sin devolver error
+	if ctxErr := streamCanceled(ctx); ctxErr != nil {
+		return "", ctxErr
+	}
+	description := strings.TrimSpace(text.String())
+	if description == "" {
+		return "", fmt.Errorf("no text returned")
+	}
+	return description, nil
+}
+
+// startGeneration comprueba que el generador está listo, ocupa un hueco en el carril de
+// prioridad y registra la llamada en modo debug. La función devuelta libera el hueco.
+func startGeneration(ctx context.Context, prompt string, config *genai.GenerateContentConfig) (func(), error) {
+	if imageGenerator == nil {
+		return nil, errServiceNotReady
+	}
+
+	done := func() {}
+	if scheduler != nil {
+		release, err := scheduler.acquire(ctx, priorityFromContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		done = release
+	}
+
+	// El semáforo global se pide después del carril: así una petición que todavía espera
+	// su carril no ocupa un hueco global que podría usar otra prioridad
+	if generationSlots != nil {
+		select {
+		case generationSlots <- struct{}{}:
+			release := done
+			done = func() {
+				<-generationSlots
+				release()
+			}
+		case <-ctx.Done():
+			done()
+			return nil, ctx.Err()
+		}
+	}
+
+	if generationPacer != nil {
+		if err := generationPacer.wait(ctx); err != nil {
+			done()
+			return nil, err
+		}
+	}
+
+	if isDebugRequest(ctx) {
+		configJSON, _ := json.Marshal(config)
+		logf(ctx, "[debug] model=%s prompt=%q config=%s", modelFor(ctx), prompt, configJSON)
+		start := time.Now()
+		release := done
+		done = func() {
+			logf(ctx, "[debug] generation took %s", time.Since(start))
+			release()
+		}
+	}
+
+	// La espera en carriles y pacer puede terminar justo cuando el cliente se va
+	if err := ctx.Err(); err != nil {
+		done()
+		return nil, err
+	}
+	return done, nil
+}
+
+// readCheckedImageStream lee la imagen y, si ENTROPY_CHECK_ENABLED=true, rechaza las
+// imágenes casi vacías o de un solo color, reintentando hasta entropyCheckRetries veces.
+func readCheckedImageStream(ctx context.Context, gen ImageGenerator, prompt string, contents []*genai.Content, config *genai.GenerateContentConfig) ([]byte, string, error) {
+	for attempt := 0; ; attempt++ {
+		var imgData []byte
+		var mimeType string
+		err := retryGeneration(ctx, func() error {
+			if altText := altTextFromContext(ctx); altText != nil {
+				altText.Reset()
+			}
+			setSafetyRatings(ctx, nil)
+			var err error
+			imgData, mimeType, err = readImageStream(ctx, gen, prompt, contents, config)
+			return err
+		})
+		if err != nil || !entropyCheckEnabled {
+			return imgData, mimeType, err
+		}
+
+		img, err := decodeImage(imgData)
+		if err != nil {
+			// Formato que no sabemos decodificar: se sirve sin comprobar
+			logf(ctx, "Skipping entropy check: %v", err)
+			return imgData, mimeType, nil
+		}
+
+		entropy := imageEntropy(img)
+		if entropy >= minImageEntropy {
+			return imgData, mimeType, nil
+		}
+		if attempt >= entropyCheckRetries {
+			return nil, "", &lowEntropyError{Entropy: entropy}
+		}
+		logf(ctx, "Generated image looks blank (entropy %.2f < %.2f), retrying (%d/%d)", entropy, minImageEntropy, attempt+1, entropyCheckRetries)
+	}
+}
+
+// generateCandidates pide varios candidatos en una sola llamada (candidate_count) y
+// devuelve la imagen de cada uno. Los candidatos sin imagen, bloqueados o en blanco se
+// descartan; solo falla si no queda ninguno.
+func generateCandidates(ctx context.Context, prompt string) ([]inputImage, error) {
+	prompt = withStyle(ctx, prompt)
+	contents := []*genai.Content{
+		{
+			Role:  "user",
+			Parts: []*genai.Part{genai.NewPartFromText(prompt)},
+		},
+	}
+	config := newGenerationConfig(ctx, modalityImage)
+
+	var images []inputImage
+	err := retryGeneration(ctx, func() error {
+		var err error
+		images, err = readCandidateStream(ctx, prompt, contents, config)
+		return err
+	})
+	if err != nil || !entropyCheckEnabled {
+		return images, err
+	}
+
+	checked := images[:0]
+	var entropy float64
+	for _, img := range images {
+		decoded, err := decodeImage(img.Data)
+		if err != nil {
+			checked = append(checked, img)
+			continue
+		}
+		if entropy = imageEntropy(decoded); entropy >= minImageEntropy {
+			checked = append(checked, img)
+		}
+	}
+	if len(checked) == 0 {
+		return nil, &lowEntropyError{Entropy: entropy}
+	}
+	return checked, nil
+}
+
+// readCandidateStream es readImageStream para varios candidatos: guarda la primera imagen
+// de cada uno según su índice, en lugar de leer solo Candidates[0].
+func readCandidateStream(ctx context.Context, prompt string, contents []*genai.Content, config *genai.GenerateContentConfig) ([]inputImage, error) {
+	done, err := startGeneration(ctx, prompt, config)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	found := map[int32]inputImage{}
+	var blockReason genai.FinishReason
+	var text strings.Builder
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { recordUsage(ctx, usage) }()
+	for result, err := range imageGenerator.GenerateStream(ctx, contents, config) {
+		if ctxErr := streamCanceled(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			reportUpstreamError(err)
+			return nil, contextError(ctx, err)
+		}
+		if result.UsageMetadata != nil {
+			usage = result.UsageMetadata
+		}
+		if result.PromptFeedback != nil && result.PromptFeedback.BlockReason != "" {
+			return nil, &blockedError{Reason: string(result.PromptFeedback.BlockReason)}
+		}
+
+		for _, candidate := range result.Candidates {
+			if blockedFinishReason(candidate.FinishReason) {
+				blockReason = candidate.FinishReason
+				continue
+			}
+			if candidate.Content == nil {
+				continue
+			}
+			for _, part := range candidate.Content.Parts {
+				if _, ok := found[candidate.Index]; !ok && part.InlineData != nil {
+					found[candidate.Index] = inputImage{
+						Data:     part.InlineData.Data,
+						MIMEType: generatedImageMIMEType(ctx, part.InlineData),
+					}
+				}
+				if part.Text != "" && !part.Thought {
+					text.WriteString(part.Text)
+				}
+			}
+		}
+	}
+	// Al cancelarse el contexto el iterador de genai termina sin devolver error
+	if ctxErr := streamCanceled(ctx); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if len(found) == 0 {
+		if blockReason != "" {
+			return nil, &blockedError{Reason: string(blockReason)}
+		}
+		return nil, &noImageError{Text: text.String()}
+	}
+	indexes := slices.Sorted(maps.Keys(found))
+	images := make([]inputImage, 0, len(indexes))
+	for _, index := range indexes {
+		images = append(images, found[index])
+	}
+	return images, nil
+}
+
+// lowEntropyError indica que el modelo devolvió una imagen degenerada (casi vacía o de un solo color).
+type lowEntropyError struct {
+	Entropy float64
+}
+
+func (e *lowEntropyError) Error() string {
+	return fmt.Sprintf("degenerate image returned (entropy %.2f below minimum %.2f)", e.Entropy, minImageEntropy)
+}
+
+// readImageStream consume el stream de genai y devuelve la primera imagen recibida.
+// Si la petición pide alt text, sigue leyendo hasta el final para recoger el texto.
+func readImageStream(ctx context.Context, gen ImageGenerator, prompt string, contents []*genai.Content, config *genai.GenerateContentConfig) ([]byte, string, error) {
+	done, err := startGeneration(ctx, prompt, config)
+	if err != nil {
+		return nil, "", err
+	}
+	defer done()
+
+	altText := altTextFromContext(ctx)
+	progress := progressFromContext(ctx)
+	preview := generationParamsFromContext(ctx).Preview
+
+	var imgData []byte
+	var imgMimeType string
+	var text strings.Builder
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { recordUsage(ctx, usage) }()
+	for result, err := range gen.GenerateStream(ctx, contents, config) {
+		if ctxErr := streamCanceled(ctx); ctxErr != nil {
+			return nil, "", ctxErr
+		}
+		if err != nil {
+			reportUpstreamError(err)
+			return nil, "", contextError(ctx, err)
+		}
+		if result.UsageMetadata != nil {
+			usage = result.UsageMetadata
+		}
+
+		if err := checkBlocked(result); err != nil {
+			return nil, "", err
+		}
+
+		if len(result.Candidates) > 0 {
+			recordSafetyRatings(ctx, result.Candidates[0].SafetyRatings)
+		}
+		if len(result.Candidates) == 0 || result.Candidates[0].Content == nil || len(result.Candidates[0].Content.Parts) == 0 {
+			continue
+		}
+
+		parts := result.Candidates[0].Content.Parts
+		for _, part := range parts {
+			// Las imágenes "thought" son borradores: solo valen si se pidió preview
+			if part.InlineData != nil && imgData == nil && (!part.Thought || preview) {
+				imgData = part.InlineData.Data
+				imgMimeType = generatedImageMIMEType(ctx, part.InlineData)
+				if altText == nil {
+					return imgData, imgMimeType, nil
+				}
+			}
+			if part.Text != "" && !part.Thought {
+				text.WriteString(part.Text)
+				if altText != nil {
+					altText.WriteString(part.Text)
+				}
+			}
+			if progress != nil && part.Text != "" {
+				if part.Thought {
+					progress("thought", part.Text)
+				} else {
+					progress("text", part.Text)
+				}
+			}
+		}
+	}
+	// Al cancelarse el contexto el iterador de genai termina sin devolver error
+	if ctxErr := streamCanceled(ctx); ctxErr != nil {
+		return nil, "", ctxErr
+	}
+	if imgData == nil {
+		return nil, "", &noImageError{Text: text.String()}
+	}
+	return imgData, imgMimeType, nil
+}
+
+// Longitud máxima del texto del modelo que se incluye en un noImageError
+const maxNoImageTextLength = 500
+
+// noImageError indica que el stream terminó sin imagen. Text guarda lo que el modelo
+// respondió en su lugar (una negativa, una pregunta...), que suele explicar el motivo.
+type noImageError struct {
+	Text string
+}
+
+func (e *noImageError) Error() string {
+	if text := e.modelText(); text != "" {
+		return fmt.Sprintf("no image returned, model replied: %s", text)
+	}
+	return "no image returned"
+}
+
+// modelText devuelve el texto del modelo en una sola línea y recortado.
+func (e *noImageError) modelText() string {
+	text := strings.Join(strings.Fields(e.Text), " ")
+	if runes := []rune(text); len(runes) > maxNoImageTextLength {
+		text = strings.TrimSpace(string(runes[:maxNoImageTextLength-1])) + "…"
+	}
+	return text
+}
+
+// streamCanceled se comprueba en cada chunk del stream: si el cliente cerró la conexión o
+// venció el plazo, se deja de leer en ese momento, liberando el carril y la respuesta
+// acumulada, en lugar de esperar a que el iterador de genai falle al pedir el siguiente.
+func streamCanceled(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logf(ctx, "Generation deadline exceeded, stopping stream")
+	} else {
+		logf(ctx, "Client disconnected, stopping generation stream")
+	}
+	return err
+}
+
+// contextError asegura que un error causado por el plazo de la petición se pueda
+// reconocer con errors.Is, aunque el SDK no lo envuelva.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
+
+// errServiceNotReady se devuelve cuando el cliente de genai no está inicializado.
+var errServiceNotReady = errors.New("service not ready")
+
+// statusClientClosedRequest es el código no estándar (de nginx) para las peticiones que
+// el cliente abandonó.
+const statusClientClosedRequest = 499
+
+// generationErrorStatus traduce un error de generación al código HTTP de la respuesta.
+func generationErrorStatus(err error) int {
+	if errors.Is(err, errServiceNotReady) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	// Nadie va a leer la respuesta, pero así los logs y métricas no lo cuentan como un 500
+	if errors.Is(err, context.Canceled) {
+		return statusClientClosedRequest
+	}
+	var lowEntropy *lowEntropyError
+	if errors.As(err, &lowEntropy) {
+		return http.StatusBadGateway
+	}
+	// No es culpa del cliente ni se arregla reintentando: la configuración del servidor
+	if upstreamAuthError(err) {
+		return http.StatusBadGateway
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// writeBodyError responde al fallo al decodificar el body JSON: 413 con el límite
+// configurado si se superó MaxBytesReader y 400 en cualquier otro caso.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, codeBodyTooLarge, fmt.Sprintf("Request body too large. Maximum size: %d MB", maxBytesErr.Limit/(1024*1024)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var contentTypeErr *contentTypeError
+	if errors.As(err, &contentTypeErr) {
+		writeError(w, codeUnsupportedMediaType, contentTypeErr.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	writeError(w, codeInvalidBody, "invalid body", http.StatusBadRequest)
+}
+
+// writeGenerationError escribe el error de una generación con el código HTTP que le
+// corresponde e incluye el request ID de Google cuando el error lo trae. Si el modelo
+// bloqueó el contenido, añade el motivo en "reason", y si respondió solo con texto, ese
+// texto en "model_text".
+func writeGenerationError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		message = fmt.Sprintf("generation timed out after %s", generationTimeout)
+	}
+	var apiErr genai.APIError
+	if upstreamAuthError(err) && errors.As(err, &apiErr) {
+		message = fmt.Sprintf("upstream authentication error: Google rejected the server credentials for the image model (%d %s)", apiErr.Code, apiErr.Status)
+	}
+	body := map[string]string{
+		"error": message,
+		"code":  generationErrorCode(err),
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		body["reason"] = blocked.Reason
+	}
+	var noImage *noImageError
+	if errors.As(err, &noImage) && noImage.modelText() != "" {
+		body["model_text"] = noImage.modelText()
+	}
+	if id := upstreamRequestID(err); id != "" {
+		w.Header().Set("X-Upstream-Request-ID", id)
+		body["upstream_request_id"] = id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(generationErrorStatus(err))
+	json.NewEncoder(w).Encode(body)
+}
+
+// upstreamRequestID busca el request ID en los detalles de un genai.APIError
+// (p. ej. google.rpc.RequestInfo o los metadata de google.rpc.ErrorInfo).
+func upstreamRequestID(err error) string {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+
+	for _, detail := range apiErr.Details {
+		if id := requestIDField(detail); id != "" {
+			return id
+		}
+		if metadata, ok := detail["metadata"].(map[string]any); ok {
+			if id := requestIDField(metadata); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// upstreamAuthError indica que Google rechazó las credenciales del servidor: API key
+// inválida, sin permisos para el modelo o service account sin el rol necesario.
+func upstreamAuthError(err error) bool {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden ||
+		apiErr.Status == "UNAUTHENTICATED" || apiErr.Status == "PERMISSION_DENIED" {
+		return true
+	}
+	// Una API key mal formada llega como 400 INVALID_ARGUMENT con motivo API_KEY_INVALID
+	for _, detail := range apiErr.Details {
+		if reason, _ := detail["reason"].(string); reason == "API_KEY_INVALID" {
+			return true
+		}
+	}
+	return false
+}
+
+func requestIDField(fields map[string]any) string {
+	for _, key := range []string{"requestId", "request_id"} {
+		if id, ok := fields[key].(string); ok && id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// blockedError indica que el modelo rechazó el prompt o la respuesta por motivos de seguridad.
+type blockedError struct {
+	Reason string
+}
+
+func (e *blockedError) Error() string {
+	return fmt.Sprintf("content blocked: %s", e.Reason)
+}
+
+func checkBlocked(result *genai.GenerateContentResponse) error {
+	if result.PromptFeedback != nil && result.PromptFeedback.BlockReason != "" {
+		return &blockedError{Reason: string(result.PromptFeedback.BlockReason)}
+	}
+	if len(result.Candidates) == 0 {
+		return nil
+	}
+	if blockedFinishReason(result.Candidates[0].FinishReason) {
+		return &blockedError{Reason: string(result.Candidates[0].FinishReason)}
+	}
+	return nil
 }
 
-func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: No se pudo cargar el archivo .env: %v", err)
+// blockedFinishReason indica si el candidato terminó por un bloqueo de seguridad.
+func blockedFinishReason(reason genai.FinishReason) bool {
+	switch reason {
+	case genai.FinishReasonSafety, genai.FinishReasonBlocklist, genai.FinishReasonProhibitedContent,
+		genai.FinishReasonSPII, genai.FinishReasonImageSafety, genai.FinishReasonImageProhibitedContent:
+		return true
 	}
+	return false
+}
 
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		log.Fatal("Error: GOOGLE_API_KEY no está configurada. Por favor, configura la variable de entorno o crea un archivo .env")
+// generateWithSoftening genera la imagen y, si está activado SAFETY_SOFTEN_ENABLED y el
+// modelo la bloquea, reintenta una vez eliminando del prompt los términos configurados.
+// Devuelve el prompt con el que se obtuvo la imagen.
+func generateWithSoftening(ctx context.Context, prompt string) ([]byte, string, string, error) {
+	imgBytes, mimeType, err := generateImageWithInput(ctx, prompt, nil, "")
+	var blocked *blockedError
+	if err == nil || !safetySoftenEnabled || !errors.As(err, &blocked) {
+		return imgBytes, mimeType, prompt, err
 	}
 
-	ctx := context.Background()
-
-	client, err := genai.NewClient(ctx, nil)
-	if err != nil {
-		log.Fatalf("client error: %v", err)
+	softened := softenPrompt(prompt)
+	if softened == "" || softened == prompt {
+		return nil, "", prompt, err
 	}
 
-	aiClient = client
+	logf(ctx, "Prompt blocked (%s), retrying with softened prompt", blocked.Reason)
+	imgBytes, mimeType, err = generateImageWithInput(ctx, softened, nil, "")
+	return imgBytes, mimeType, softened, err
+}
 
-	maxBodySize = int64(100 * 1024 * 1024)
-	if maxBodySizeEnv := os.Getenv("MAX_BODY_SIZE_MB"); maxBodySizeEnv != "" {
-		var mb int64
-		if _, err := fmt.Sscanf(maxBodySizeEnv, "%d", &mb); err == nil {
-			maxBodySize = mb * 1024 * 1024
-		}
+func softenPrompt(prompt string) string {
+	for _, pattern := range softenPatterns {
+		prompt = pattern.ReplaceAllString(prompt, "")
 	}
+	return strings.Join(strings.Fields(prompt), " ")
+}
 
-	// Cargar las 20 API keys predefinidas
-	loadPredefinedAPIKeys()
+func setSoftenedPromptHeaders(w http.ResponseWriter, original, used string) {
+	if used == original {
+		return
+	}
+	w.Header().Set("X-Prompt-Softened", "true")
+	w.Header().Set("X-Effective-Prompt", url.QueryEscape(used))
+}
 
-	log.Println("=== API Keys cargadas ===")
-	keysMutex.RLock()
-	for key := range apiKeys {
-		log.Printf("API Key: %s (Límite: %d llamadas)", key, apiKeys[key].Limit)
+// supportedInputType indica si una imagen de entrada se puede enviar al modelo.
+func supportedInputType(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "image/webp":
+		return true
 	}
-	keysMutex.RUnlock()
-	log.Printf("Total de API Keys: %d", len(apiKeys))
-	log.Println("===========================")
+	return false
+}
 
-	// Crear mux con middleware
-	mux := http.NewServeMux()
-	mux.HandleFunc("/text-to-image", limitBodySize(validateAPIKey(handleTextToImage)))
-	mux.HandleFunc("/resize", limitBodySize(validateAPIKey(handleResize)))
-	mux.HandleFunc("/sketch-to-image", limitBodySize(validateAPIKey(handleSketchToImage)))
-	mux.HandleFunc("/magic-eraser", limitBodySize(validateAPIKey(handleMagicEraser)))
-	mux.HandleFunc("/api-keys", handleListAPIKeys)
+func unsupportedInputTypeMessage(mimeType string) string {
+	return fmt.Sprintf("unsupported image type %s. Supported types: image/png, image/jpeg, image/webp", mimeType)
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+// detectImageMIMEType identifica el tipo de imagen a partir de sus primeros bytes.
+func detectImageMIMEType(data []byte) string {
+	return http.DetectContentType(data)
+}
 
-	server := &http.Server{
-		Addr:           ":" + port,
-		Handler:        mux,
-		ReadTimeout:    30 * 60 * 1000000000, // 30 minutos
-		WriteTimeout:   30 * 60 * 1000000000, // 30 minutos
-		MaxHeaderBytes: 10 << 20,             // 10MB para headers
+// generatedImageMIMEType decide el tipo de una imagen devuelta por el modelo. Manda el
+// tipo detectado en los bytes, porque el declarado a veces falta o no coincide; si los
+// bytes no son una imagen reconocible se usa el declarado y, en último caso, PNG.
+func generatedImageMIMEType(ctx context.Context, blob *genai.Blob) string {
+	if sniffed := detectImageMIMEType(blob.Data); strings.HasPrefix(sniffed, "image/") {
+		if blob.MIMEType != "" && blob.MIMEType != sniffed {
+			logf(ctx, "Model reported %s for %s image bytes, using %s", blob.MIMEType, sniffed, sniffed)
+		}
+		return sniffed
 	}
-
-	log.Printf("API listening on :%s (Max body size: %d MB)", port, maxBodySize/(1024*1024))
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("server error: %v", err)
+	if blob.MIMEType != "" && blob.MIMEType != "application/octet-stream" {
+		return blob.MIMEType
 	}
+	return "image/png"
 }
 
-func handleTextToImage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, "POST only", http.StatusMethodNotAllowed)
-		return
+func writeImage(w http.ResponseWriter, r *http.Request, img []byte, mimeType string) {
+	if mimeType == "" {
+		mimeType = "image/png"
+	}
+	img, mimeType = applyOutputCap(r.Context(), w, img, mimeType)
+	setImageMetadataHeaders(w, img)
+
+	var lqip string
+	if lqipEnabled {
+		if data, err := makeLQIP(img); err != nil {
+			logf(r.Context(), "Error generating LQIP: %v", err)
+		} else {
+			lqip = "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+			w.Header().Set("X-LQIP", lqip)
+		}
 	}
 
-	var req TextToImageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if err.Error() == "http: request body too large" {
-			writeError(w, fmt.Sprintf("Request body too large. Maximum size: %d MB", maxBodySize/(1024*1024)), http.StatusRequestEntityTooLarge)
+	// Con almacenamiento configurado la respuesta es siempre JSON con la URL de la imagen
+	if imageStorage != nil {
+		url, err := storeImage(r.Context(), img, mimeType)
+		if err != nil {
+			logf(r.Context(), "Error storing image: %v", err)
+			writeError(w, codeInternalError, "failed to store image", http.StatusInternalServerError)
 			return
 		}
-		writeError(w, "invalid body", http.StatusBadRequest)
+		body := map[string]interface{}{
+			"url":            url,
+			"mime_type":      mimeType,
+			"safety_ratings": safetyRatingsFromContext(r.Context()),
+		}
+		if lqip != "" {
+			body["lqip"] = lqip
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(addUsage(r.Context(), body))
 		return
 	}
-	if req.Prompt == "" {
-		writeError(w, "missing prompt", http.StatusBadRequest)
-		return
+
+	format, _ := responseFormat(r)
+	switch format {
+	case formatJSON:
+		body := map[string]interface{}{
+			"image_base64":   base64.StdEncoding.EncodeToString(img),
+			"mime_type":      mimeType,
+			"safety_ratings": safetyRatingsFromContext(r.Context()),
+		}
+		if lqip != "" {
+			body["lqip"] = lqip
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(addUsage(r.Context(), body))
+	case formatDataURI:
+		dataURI := fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(img))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(dataURI)))
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, dataURI)
+	default:
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(img)
 	}
+}
 
-	ctx := r.Context()
-	imgBytes, mimeType, err := generateSingleImage(ctx, req.Prompt)
+// setImageMetadataHeaders informa de las dimensiones y el formato de la imagen devuelta,
+// leyendo solo su cabecera, para que el cliente pueda maquetar antes de descargarla.
+func setImageMetadataHeaders(w http.ResponseWriter, img []byte) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(img))
 	if err != nil {
-		log.Printf("Error generating image: %v", err)
-		writeError(w, fmt.Sprintf("generation error: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	writeImage(w, imgBytes, mimeType)
+	w.Header().Set("X-Image-Width", strconv.Itoa(config.Width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(config.Height))
+	w.Header().Set("X-Image-Format", format)
 }
 
-func handleResize(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, "POST only", http.StatusMethodNotAllowed)
-		return
-	}
+const (
+	formatRaw     = "raw"
+	formatJSON    = "json"
+	formatDataURI = "datauri"
+)
 
-	var req ResizeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if err.Error() == "http: request body too large" {
-			writeError(w, fmt.Sprintf("Request body too large. Maximum size: %d MB", maxBodySize/(1024*1024)), http.StatusRequestEntityTooLarge)
-			return
+// responseFormat lee el formato de respuesta de ?format= o, si no viene, de la cabecera
+// Accept. Devuelve false si el valor de ?format= no es válido.
+func responseFormat(r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+		if acceptsJSON(r) {
+			return formatJSON, true
 		}
-		writeError(w, "invalid body", http.StatusBadRequest)
-		return
-	}
-	if req.ImageBase64 == "" {
-		writeError(w, "missing image", http.StatusBadRequest)
-		return
-	}
-	if req.Scale != 2 && req.Scale != 4 {
-		writeError(w, "scale must be 2 or 4", http.StatusBadRequest)
-		return
+		return formatRaw, true
+	case formatRaw:
+		return formatRaw, true
+	case formatJSON, formatDataURI:
+		return format, true
+	default:
+		return format, false
 	}
+}
 
-	imgData, err := base64.StdEncoding.DecodeString(req.ImageBase64)
-	if err != nil {
-		writeError(w, "invalid base64", http.StatusBadRequest)
-		return
+// optimizeOutput devuelve la codificación más pequeña de la imagen cuando la petición
+// pide optimize=true e informa del formato elegido y los tamaños en cabeceras de depuración.
+func optimizeOutput(ctx context.Context, w http.ResponseWriter, optimize bool, img []byte, mimeType string) ([]byte, string) {
+	if !optimize {
+		return img, mimeType
 	}
 
-	prompt := fmt.Sprintf("Resize this image by x%d preserving details.", req.Scale)
+	// Se reduce antes de comparar para que los tamaños reportados sean los finales
+	img, mimeType = applyOutputCap(ctx, w, img, mimeType)
 
-	ctx := r.Context()
-	imgBytes, mimeType, err := generateImageFromImage(ctx, imgData, "image/png", prompt)
+	best, bestMime, sizes, err := optimizeEncoding(img, mimeType, optimizeFormats, optimizeJPEGQuality)
 	if err != nil {
-		log.Printf("Error resizing image: %v", err)
-		writeError(w, fmt.Sprintf("resize error: %v", err), http.StatusInternalServerError)
-		return
+		logf(ctx, "Error optimizing output encoding: %v", err)
+		return img, mimeType
 	}
 
-	writeImage(w, imgBytes, mimeType)
+	reported := make([]string, 0, len(sizes))
+	for _, format := range append([]string{"original"}, optimizeFormats...) {
+		if size, ok := sizes[format]; ok {
+			reported = append(reported, fmt.Sprintf("%s=%d", format, size))
+		}
+	}
+	w.Header().Set("X-Optimize-Format", bestMime)
+	w.Header().Set("X-Optimize-Sizes", strings.Join(reported, ", "))
+	return best, bestMime
 }
 
-func handleSketchToImage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, "POST only", http.StatusMethodNotAllowed)
-		return
+// validOutputFormat comprueba output_format, output_quality y background_color. WebP no
+// se puede elegir porque no hay codificador WebP en Go puro.
+func validOutputFormat(format string, quality int, background string, optimize bool) error {
+	switch format {
+	case "", "png", "jpeg":
+	case "webp":
+		return errors.New("webp output is not supported, use png or jpeg")
+	default:
+		return errors.New("output_format must be png or jpeg")
+	}
+	if quality != 0 && (quality < 1 || quality > 100) {
+		return errors.New("output_quality must be between 1 and 100")
 	}
+	if format != "" && optimize {
+		return errors.New("output_format cannot be combined with optimize")
+	}
+	if _, err := parseHexColor(background); err != nil {
+		return fmt.Errorf("background_color: %w", err)
+	}
+	return nil
+}
 
-	var req SketchToImageRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if err.Error() == "http: request body too large" {
-			writeError(w, fmt.Sprintf("Request body too large. Maximum size: %d MB", maxBodySize/(1024*1024)), http.StatusRequestEntityTooLarge)
-			return
-		}
-		writeError(w, "invalid body", http.StatusBadRequest)
-		return
+// convertOutput vuelve a codificar la imagen en el formato pedido con output_format.
+// Si no se pidió formato o la imagen ya está en él, se devuelve sin cambios. Al pasar a
+// JPEG, que no tiene canal alfa, las zonas transparentes se rellenan con background.
+func convertOutput(img []byte, mimeType, format string, quality int, background string) ([]byte, string, error) {
+	if format == "" || mimeType == "image/"+format {
+		return img, mimeType, nil
 	}
-	if req.ImageBase64 == "" || req.Description == "" {
-		writeError(w, "missing fields", http.StatusBadRequest)
-		return
+	if quality == 0 {
+		quality = defaultJPEGQuality
 	}
 
-	imgData, err := base64.StdEncoding.DecodeString(req.ImageBase64)
+	src, err := decodeImage(img)
 	if err != nil {
-		writeError(w, "invalid base64", http.StatusBadRequest)
-		return
+		return nil, "", err
+	}
+	if format == "jpeg" {
+		bg, err := parseHexColor(background)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := encodeJPEG(flattenImage(src, bg), quality)
+		return data, "image/jpeg", err
 	}
+	data, err := encodePNG(src)
+	return data, "image/png", err
+}
 
-	prompt := fmt.Sprintf("Interpret this sketch as '%s'.", req.Description)
+// applyOutputCap aplica MAX_OUTPUT_WIDTH/MAX_OUTPUT_HEIGHT y marca la respuesta si hubo que reducir.
+func applyOutputCap(ctx context.Context, w http.ResponseWriter, img []byte, mimeType string) ([]byte, string) {
+	img, mimeType, downscaled := capOutput(ctx, img, mimeType)
+	if downscaled {
+		w.Header().Set("X-Image-Downscaled", "true")
+	}
+	return img, mimeType
+}
 
-	ctx := r.Context()
-	imgBytes, mimeType, err := generateImageFromImage(ctx, imgData, "image/png", prompt)
+// capOutput es applyOutputCap sin la cabecera, para cuando ya se han enviado (SSE).
+func capOutput(ctx context.Context, img []byte, mimeType string) ([]byte, string, bool) {
+	if maxOutputWidth <= 0 && maxOutputHeight <= 0 {
+		return img, mimeType, false
+	}
+	capped, cappedMime, downscaled, err := capOutputResolution(img, mimeType)
 	if err != nil {
-		log.Printf("Error converting sketch to image: %v", err)
-		writeError(w, fmt.Sprintf("sketch error: %v", err), http.StatusInternalServerError)
-		return
+		logf(ctx, "Error enforcing max output resolution: %v", err)
+		return img, mimeType, false
 	}
-
-	writeImage(w, imgBytes, mimeType)
+	return capped, cappedMime, downscaled
 }
 
-func handleMagicEraser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, "POST only", http.StatusMethodNotAllowed)
-		return
-	}
+// writeTiles divide la imagen en una cuadrícula de tileSize píxeles y la devuelve como JSON.
+// Las teselas del borde derecho e inferior pueden ser más pequeñas.
+func writeTiles(ctx context.Context, w http.ResponseWriter, img []byte, mimeType string, tileSize int) {
+	img, _ = applyOutputCap(ctx, w, img, mimeType)
 
-	var req MagicEraserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if err.Error() == "http: request body too large" {
-			writeError(w, fmt.Sprintf("Request body too large. Maximum size: %d MB", maxBodySize/(1024*1024)), http.StatusRequestEntityTooLarge)
-			return
-		}
-		writeError(w, "invalid body", http.StatusBadRequest)
-		return
-	}
-	if req.ImageBase64 == "" {
-		writeError(w, "missing image", http.StatusBadRequest)
+	src, err := decodeImage(img)
+	if err != nil {
+		logf(ctx, "Error decoding image for tiling: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("tiling error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	imgData, err := base64.StdEncoding.DecodeString(req.ImageBase64)
+	tiles, err := splitTiles(src, tileSize)
 	if err != nil {
-		writeError(w, "invalid base64", http.StatusBadRequest)
+		logf(ctx, "Error splitting image into tiles: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("tiling error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	prompt := "Remove the pink masked area and reconstruct the background."
+	bounds := src.Bounds()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addUsage(ctx, map[string]interface{}{
+		"width":     bounds.Dx(),
+		"height":    bounds.Dy(),
+		"tile_size": tileSize,
+		"columns":   (bounds.Dx() + tileSize - 1) / tileSize,
+		"rows":      (bounds.Dy() + tileSize - 1) / tileSize,
+		"mime_type": "image/png",
+		"tiles":     tiles,
+	}))
+}
 
-	ctx := r.Context()
-	imgBytes, mimeType, err := generateImageFromImage(ctx, imgData, "image/png", prompt)
-	if err != nil {
-		log.Printf("Error with magic eraser: %v", err)
-		writeError(w, fmt.Sprintf("eraser error: %v", err), http.StatusInternalServerError)
-		return
+// acceptsJSON indica si el cliente pide explícitamente application/json en Accept.
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
 	}
+	return false
+}
 
-	writeImage(w, imgBytes, mimeType)
+// isDryRun indica si la petición solo quiere validarse (?dry_run=true), sin generar.
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
 }
 
-func generateSingleImage(ctx context.Context, prompt string) ([]byte, string, error) {
-	contents := []*genai.Content{
-		{
-			Role: "user",
-			Parts: []*genai.Part{
-				genai.NewPartFromText(prompt),
-			},
-		},
+// writeDryRun responde a una petición dry_run que ha pasado todas las validaciones.
+func writeDryRun(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"valid": true})
+}
+
+func limitBodySize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Limitar el tamaño del body usando MaxBytesReader
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next(w, r)
 	}
+}
 
-	config := &genai.GenerateContentConfig{
-		ResponseModalities: []string{
-			"IMAGE",
-			"TEXT",
-		},
-		ImageConfig: &genai.ImageConfig{
-			ImageSize: "1K",
-		},
+// withTimeout limita la duración de cada petición a GENERATION_TIMEOUT_SECONDS. Al
+// vencer el plazo se cancela la llamada a genai y el handler responde 504.
+func withTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), generationTimeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
 	}
+}
 
-	for result, err := range aiClient.Models.GenerateContentStream(ctx, modelName, contents, config) {
-		if err != nil {
-			return nil, "", err
+// debugOverride activa el logging detallado para una única petición cuando llega
+// X-Debug: true junto con una X-Admin-Key válida. Sin clave de admin se ignora.
+func debugOverride(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Debug") != "true" {
+			next(w, r)
+			return
 		}
 
-		if len(result.Candidates) == 0 || result.Candidates[0].Content == nil || len(result.Candidates[0].Content.Parts) == 0 {
-			continue
+		adminKey := r.Header.Get("X-Admin-Key")
+		if adminAPIKey == "" || subtle.ConstantTimeCompare([]byte(adminKey), []byte(adminAPIKey)) != 1 {
+			logf(r.Context(), "Ignoring X-Debug header from %s: missing or invalid admin key", r.RemoteAddr)
+			next(w, r)
+			return
 		}
 
-		parts := result.Candidates[0].Content.Parts
-		for _, part := range parts {
-			if part.InlineData != nil {
-				mimeType := part.InlineData.MIMEType
-				if mimeType == "" {
-					mimeType = "image/png"
-				}
-				return part.InlineData.Data, mimeType, nil
-			}
-		}
+		start := time.Now()
+		logf(r.Context(), "[debug] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		next(w, r.WithContext(context.WithValue(r.Context(), debugContextKey{}, true)))
+		logf(r.Context(), "[debug] %s %s completed in %s", r.Method, r.URL.Path, time.Since(start))
 	}
-
-	return nil, "", fmt.Errorf("no image returned")
 }
 
-func generateImageFromImage(ctx context.Context, imageData []byte, imageMimeType string, prompt string) ([]byte, string, error) {
-	parts := []*genai.Part{
-		{
-			InlineData: &genai.Blob{
-				MIMEType: imageMimeType,
-				Data:     imageData,
-			},
-		},
-		genai.NewPartFromText(prompt),
+// withAltText pide al modelo una descripción breve junto a la imagen y la devuelve
+// en la cabecera X-Alt-Text. Solo actúa si ALT_TEXT_ENABLED=true.
+func withAltText(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !altTextEnabled {
+			next(w, r)
+			return
+		}
+
+		altText := &strings.Builder{}
+		ctx := context.WithValue(r.Context(), altTextContextKey{}, altText)
+		next(&altTextWriter{ResponseWriter: w, altText: altText}, r.WithContext(ctx))
 	}
+}
 
-	contents := []*genai.Content{
-		{
-			Role:  "user",
-			Parts: parts,
-		},
+// altTextWriter añade X-Alt-Text justo antes de escribir una respuesta correcta.
+type altTextWriter struct {
+	http.ResponseWriter
+	altText     *strings.Builder
+	wroteHeader bool
+}
+
+func (w *altTextWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if statusCode == http.StatusOK {
+			if text := sanitizeAltText(w.altText.String()); text != "" {
+				w.Header().Set("X-Alt-Text", text)
+			}
+		}
 	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
 
-	config := &genai.GenerateContentConfig{
-		ResponseModalities: []string{
-			"IMAGE",
-			"TEXT",
-		},
-		ImageConfig: &genai.ImageConfig{
-			ImageSize: "1K",
-		},
+func (w *altTextWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
 	}
+	return w.ResponseWriter.Write(b)
+}
 
-	for result, err := range aiClient.Models.GenerateContentStream(ctx, modelName, contents, config) {
-		if err != nil {
-			return nil, "", err
-		}
+func (w *altTextWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-		if len(result.Candidates) == 0 || result.Candidates[0].Content == nil || len(result.Candidates[0].Content.Parts) == 0 {
-			continue
-		}
+func altTextFromContext(ctx context.Context) *strings.Builder {
+	altText, _ := ctx.Value(altTextContextKey{}).(*strings.Builder)
+	return altText
+}
 
-		resultParts := result.Candidates[0].Content.Parts
-		for _, part := range resultParts {
-			if part.InlineData != nil {
-				mimeType := part.InlineData.MIMEType
-				if mimeType == "" {
-					mimeType = "image/png"
-				}
-				return part.InlineData.Data, mimeType, nil
-			}
-		}
+func withAltTextInstruction(ctx context.Context, prompt string) string {
+	if altTextFromContext(ctx) == nil {
+		return prompt
 	}
-
-	return nil, "", fmt.Errorf("no image returned")
+	return prompt + " " + altTextInstruction
 }
 
-func writeImage(w http.ResponseWriter, img []byte, mimeType string) {
-	if mimeType == "" {
-		mimeType = "image/png"
+// sanitizeAltText deja el texto en una sola línea y lo recorta a maxAltTextLength runas.
+func sanitizeAltText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxAltTextLength {
+		text = strings.TrimSpace(string(runes[:maxAltTextLength-1])) + "…"
 	}
-	w.Header().Set("Content-Type", mimeType)
-	w.WriteHeader(http.StatusOK)
-	w.Write(img)
+	return text
 }
 
-func limitBodySize(next http.HandlerFunc) http.HandlerFunc {
+func isDebugRequest(ctx context.Context) bool {
+	debug, _ := ctx.Value(debugContextKey{}).(bool)
+	return debug
+}
+
+func limitEditBodySize(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Limitar el tamaño del body usando MaxBytesReader
-		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		r.Body = http.MaxBytesReader(w, r.Body, maxEditBodySize)
 		next(w, r)
 	}
 }
@@ -444,41 +3460,113 @@ func generateRandomKey() string {
 
 func validateAPIKey(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			apiKey = r.URL.Query().Get("api_key")
-		}
-
-		if apiKey == "" {
-			writeError(w, "API key is required. Provide it in X-API-Key header or api_key query parameter", http.StatusUnauthorized)
-			return
-		}
-
-		keysMutex.RLock()
-		keyInfo, exists := apiKeys[apiKey]
-		keysMutex.RUnlock()
-
-		if !exists {
-			writeError(w, "Invalid API key", http.StatusUnauthorized)
+		keyInfo, ok := authenticateAPIKey(w, r)
+		if !ok {
 			return
 		}
 
 		keyInfo.mutex.Lock()
 		if keyInfo.Used >= keyInfo.Limit {
 			keyInfo.mutex.Unlock()
-			writeError(w, fmt.Sprintf("API key limit exceeded. Used: %d/%d", keyInfo.Used, keyInfo.Limit), http.StatusTooManyRequests)
+			writeError(w, codeQuotaExceeded, fmt.Sprintf("API key limit exceeded. Used: %d/%d", keyInfo.Used, keyInfo.Limit), http.StatusTooManyRequests)
 			return
 		}
-		keyInfo.Used++
+		// Una validación en seco no consume llamadas, aunque sí exige tener cupo
+		if !isDryRun(r) {
+			keyInfo.Used++
+		}
 		keyInfo.mutex.Unlock()
 
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, keyInfo.Key)))
+	}
+}
+
+// reserveAPIKeyCalls consume n llamadas más de la key de la petición, para los endpoints que
+// generan varias imágenes (validateAPIKey ya cobró la primera). Si no quedan n llamadas
+// responde 429 y devuelve también la que cobró validateAPIKey.
+func reserveAPIKeyCalls(w http.ResponseWriter, r *http.Request, n int) bool {
+	keyInfo := apiKeyInfoFromContext(r.Context())
+	if keyInfo == nil || n <= 0 {
+		return true
+	}
+
+	keyInfo.mutex.Lock()
+	defer keyInfo.mutex.Unlock()
+	if keyInfo.Used+n > keyInfo.Limit {
+		keyInfo.Used--
+		writeError(w, codeQuotaExceeded, fmt.Sprintf("API key limit exceeded: this request needs %d calls. Used: %d/%d", n+1, keyInfo.Used, keyInfo.Limit), http.StatusTooManyRequests)
+		return false
+	}
+	keyInfo.Used += n
+	return true
+}
+
+// refundAPIKeyCalls devuelve las llamadas reservadas para imágenes que no se llegaron a generar.
+func refundAPIKeyCalls(ctx context.Context, n int) {
+	keyInfo := apiKeyInfoFromContext(ctx)
+	if keyInfo == nil || n <= 0 {
+		return
+	}
+
+	keyInfo.mutex.Lock()
+	keyInfo.Used = max(keyInfo.Used-n, 0)
+	keyInfo.mutex.Unlock()
+}
+
+func apiKeyInfoFromContext(ctx context.Context) *apiKeyInfo {
+	key := apiKeyFromContext(ctx)
+	if key == "" {
+		return nil
+	}
+	keysMutex.RLock()
+	defer keysMutex.RUnlock()
+	return apiKeys[key]
+}
+
+// requireAPIKey exige una API key válida sin consumir llamadas: para los endpoints que no
+// generan, como las subidas por partes.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyInfo, ok := authenticateAPIKey(w, r)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, keyInfo.Key)))
+	}
+}
+
+// apiKeyFromContext devuelve la API key con la que se autenticó la petición.
+func apiKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(apiKeyContextKey{}).(string)
+	return key
+}
+
+// authenticateAPIKey busca la API key de la petición y, si falta o no existe, responde 401.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request) (*apiKeyInfo, bool) {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("api_key")
+	}
+
+	if apiKey == "" {
+		writeError(w, codeMissingAPIKey, "API key is required. Provide it in X-API-Key header or api_key query parameter", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	keysMutex.RLock()
+	keyInfo, exists := apiKeys[apiKey]
+	keysMutex.RUnlock()
+
+	if !exists {
+		writeError(w, codeInvalidAPIKey, "Invalid API key", http.StatusUnauthorized)
+		return nil, false
 	}
+	return keyInfo, true
 }
 
 func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeError(w, "GET only", http.StatusMethodNotAllowed)
+		writeError(w, codeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -503,10 +3591,57 @@ func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func writeError(w http.ResponseWriter, message string, statusCode int) {
+// handleNotFound atiende las rutas no registradas con el mismo formato JSON que el
+// resto de errores, en lugar del 404 en texto plano del mux.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, codeNotFound, "not found", http.StatusNotFound)
+}
+
+// handleHealth es la liveness probe: no toca el cliente de genai.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, codeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// handleReady es la readiness probe: el servidor solo está listo con el cliente de genai inicializado.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, codeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Las credenciales se validan al arrancar: sin ellas el servidor no llega a escuchar
+	reason := ""
+	if imageGenerator == nil {
+		reason = "genai client not initialized"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "not ready",
+			"reason": reason,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ready",
+	})
+}
+
+func writeError(w http.ResponseWriter, code, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(map[string]string{
 		"error": message,
+		"code":  code,
 	})
 }
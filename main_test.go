@@ -0,0 +1,1108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"iter"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// fakeGenerator sustituye al modelo: devuelve siempre la misma imagen o el mismo error
+// y guarda lo que recibió en la última llamada. Si tiene responses, las emite como stream
+// y Generate las lee igual que con el modelo real.
+type fakeGenerator struct {
+	image     []byte
+	mimeType  string
+	err       error
+	responses []*genai.GenerateContentResponse
+	// afterChunk se llama después de emitir cada chunk del stream
+	afterChunk func()
+
+	calls    int
+	streamed int
+	prompt   string
+	images   []inputImage
+	contents []*genai.Content
+	model    string
+}
+
+func (g *fakeGenerator) Generate(ctx context.Context, prompt string, images []inputImage) ([]byte, string, error) {
+	if g.responses != nil {
+		g.prompt = prompt
+		g.images = images
+		return generateFromStream(ctx, g, prompt, images)
+	}
+	g.calls++
+	g.prompt = prompt
+	g.images = images
+	g.model = modelFor(ctx)
+	if g.err != nil {
+		return nil, "", g.err
+	}
+	return g.image, g.mimeType, nil
+}
+
+func (g *fakeGenerator) GenerateStream(ctx context.Context, contents []*genai.Content, config *genai.GenerateContentConfig) iter.Seq2[*genai.GenerateContentResponse, error] {
+	g.calls++
+	g.contents = contents
+	g.model = modelFor(ctx)
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		if g.err != nil {
+			yield(nil, g.err)
+			return
+		}
+		for _, resp := range g.responses {
+			g.streamed++
+			if !yield(resp, nil) {
+				return
+			}
+			if g.afterChunk != nil {
+				g.afterChunk()
+			}
+		}
+	}
+}
+
+// modelResponse construye un chunk del stream con las partes dadas.
+func modelResponse(parts ...*genai.Part) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Role: "model", Parts: parts}}},
+	}
+}
+
+// useGenerator instala el generador durante el test.
+func useGenerator(t *testing.T, g ImageGenerator) {
+	t.Helper()
+	previous := imageGenerator
+	imageGenerator = g
+	t.Cleanup(func() { imageGenerator = previous })
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	data, err := encodePNG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func postJSON(t *testing.T, handler http.HandlerFunc, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func decodeErrorBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body is not JSON: %v (%q)", err, rec.Body.String())
+	}
+	return body
+}
+
+func TestTextToImageSuccess(t *testing.T) {
+	png := testPNG(t, 32, 32)
+	gen := &fakeGenerator{image: png, mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "  a red fox  "})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Errorf("body is not the generated image")
+	}
+	if gen.calls != 1 {
+		t.Errorf("generator called %d times, want 1", gen.calls)
+	}
+	if gen.prompt != "a red fox" {
+		t.Errorf("prompt = %q, want the trimmed prompt", gen.prompt)
+	}
+	if len(gen.images) != 0 {
+		t.Errorf("text-to-image sent %d input images", len(gen.images))
+	}
+}
+
+func TestTextToImageJSONFormat(t *testing.T) {
+	png := testPNG(t, 16, 8)
+	useGenerator(t, &fakeGenerator{image: png, mimeType: "image/png"})
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image?format=json", map[string]any{"prompt": "a red fox"})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		ImageBase64 string `json:"image_base64"`
+		MIMEType    string `json:"mime_type"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ImageBase64 != base64.StdEncoding.EncodeToString(png) || body.MIMEType != "image/png" {
+		t.Errorf("unexpected JSON body: %s", rec.Body.String())
+	}
+	if rec.Header().Get("X-Image-Width") != "16" || rec.Header().Get("X-Image-Height") != "8" {
+		t.Errorf("dimension headers = %sx%s, want 16x8", rec.Header().Get("X-Image-Width"), rec.Header().Get("X-Image-Height"))
+	}
+}
+
+func TestTextToImageBlocked(t *testing.T) {
+	useGenerator(t, &fakeGenerator{err: &blockedError{Reason: "SAFETY"}})
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox"})
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422", rec.Code)
+	}
+	body := decodeErrorBody(t, rec)
+	if body["code"] != codeContentBlocked || body["reason"] != "SAFETY" {
+		t.Errorf("unexpected error body: %v", body)
+	}
+}
+
+func TestTextToImageGenerationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"upstream", errors.New("boom"), http.StatusInternalServerError, codeUpstreamError},
+		{"no image", &noImageError{Text: "I can't draw that"}, http.StatusInternalServerError, codeNoImage},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout, codeGenerationTimeout},
+		{"degenerate", &lowEntropyError{Entropy: 0.1}, http.StatusBadGateway, codeDegenerateImage},
+		{"not ready", errServiceNotReady, http.StatusServiceUnavailable, codeServiceNotReady},
+		{"permission denied", genai.APIError{Code: 403, Status: "PERMISSION_DENIED"}, http.StatusBadGateway, codeUpstreamAuthError},
+		{"invalid api key", genai.APIError{Code: 400, Status: "INVALID_ARGUMENT", Details: []map[string]any{{"reason": "API_KEY_INVALID"}}}, http.StatusBadGateway, codeUpstreamAuthError},
+		{"transient", genai.APIError{Code: 503, Status: "UNAVAILABLE"}, http.StatusInternalServerError, codeUpstreamError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useGenerator(t, &fakeGenerator{err: tt.err})
+
+			rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox"})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if body := decodeErrorBody(t, rec); body["code"] != tt.code {
+				t.Errorf("code = %q, want %q", body["code"], tt.code)
+			}
+		})
+	}
+}
+
+func TestTextToImageWithoutGenerator(t *testing.T) {
+	useGenerator(t, nil)
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox"})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestTextToImageValidationSkipsGenerator(t *testing.T) {
+	gen := &fakeGenerator{image: testPNG(t, 8, 8), mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "   "})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty prompt: status = %d, want 400", rec.Code)
+	}
+	rec = postJSON(t, handleTextToImage, "/text-to-image?dry_run=true", map[string]any{"prompt": "a red fox"})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"valid":true`) {
+		t.Errorf("dry run: status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if gen.calls != 0 {
+		t.Errorf("generator called %d times, want 0", gen.calls)
+	}
+}
+
+func TestResizeSendsInputImage(t *testing.T) {
+	input := testPNG(t, 16, 16)
+	output := testPNG(t, 32, 32)
+	gen := &fakeGenerator{image: output, mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleResize, "/resize", map[string]any{
+		"image_base64": base64.StdEncoding.EncodeToString(input),
+		"scale":        2,
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if len(gen.images) != 1 || !bytes.Equal(gen.images[0].Data, input) || gen.images[0].MIMEType != "image/png" {
+		t.Errorf("generator did not receive the input image")
+	}
+}
+
+func TestResizeBlocked(t *testing.T) {
+	useGenerator(t, &fakeGenerator{err: &blockedError{Reason: "IMAGE_SAFETY"}})
+
+	rec := postJSON(t, handleResize, "/resize", map[string]any{
+		"image_base64": base64.StdEncoding.EncodeToString(testPNG(t, 16, 16)),
+		"scale":        2,
+	})
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422", rec.Code)
+	}
+	if body := decodeErrorBody(t, rec); body["code"] != codeContentBlocked {
+		t.Errorf("code = %q, want %q", body["code"], codeContentBlocked)
+	}
+}
+
+func TestReplaceSubjectSendsBothImages(t *testing.T) {
+	base := testPNG(t, 16, 16)
+	reference := testPNG(t, 8, 8)
+	gen := &fakeGenerator{image: testPNG(t, 16, 16), mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleReplaceSubject, "/replace-subject", map[string]any{
+		"base_base64":      base64.StdEncoding.EncodeToString(base),
+		"reference_base64": base64.StdEncoding.EncodeToString(reference),
+		"prompt":           "replace the dog with the cat from the reference.",
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if len(gen.images) != 2 || !bytes.Equal(gen.images[0].Data, base) || !bytes.Equal(gen.images[1].Data, reference) {
+		t.Fatalf("generator did not receive the base and reference images in order")
+	}
+	if !strings.Contains(gen.prompt, "replace the dog with the cat from the reference.") {
+		t.Errorf("prompt does not include the requested replacement: %q", gen.prompt)
+	}
+}
+
+func TestReplaceSubjectRequiresPrompt(t *testing.T) {
+	gen := &fakeGenerator{}
+	useGenerator(t, gen)
+	img := base64.StdEncoding.EncodeToString(testPNG(t, 8, 8))
+
+	rec := postJSON(t, handleReplaceSubject, "/replace-subject", map[string]any{
+		"base_base64":      img,
+		"reference_base64": img,
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if body := decodeErrorBody(t, rec); body["code"] != codeMissingPrompt {
+		t.Errorf("code = %q, want %q", body["code"], codeMissingPrompt)
+	}
+	if gen.calls != 0 {
+		t.Errorf("generator called without a prompt")
+	}
+}
+
+func TestModelOverride(t *testing.T) {
+	previous := allowedModels
+	allowedModels = []string{"gemini-test-image"}
+	t.Cleanup(func() { allowedModels = previous })
+
+	gen := &fakeGenerator{image: testPNG(t, 8, 8), mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "model": "gemini-test-image"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if gen.model != "gemini-test-image" {
+		t.Errorf("model = %q, want the requested model", gen.model)
+	}
+
+	rec = postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox"})
+	if rec.Code != http.StatusOK || gen.model != modelName {
+		t.Errorf("without model: status = %d, model = %q, want the default %q", rec.Code, gen.model, modelName)
+	}
+
+	rec = postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "model": "some-other-model"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("disallowed model: status = %d, want 400", rec.Code)
+	}
+	if gen.calls != 2 {
+		t.Errorf("generator called %d times, want 2", gen.calls)
+	}
+}
+
+func TestTextToImageReadsModelStream(t *testing.T) {
+	png := testPNG(t, 16, 16)
+	gen := &fakeGenerator{responses: []*genai.GenerateContentResponse{
+		modelResponse(&genai.Part{Text: "Drawing a fox", Thought: true}),
+		modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: png}}),
+	}}
+	useGenerator(t, gen)
+
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox"})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(rec.Body.Bytes(), png) {
+		t.Errorf("body is not the streamed image")
+	}
+	if gen.calls != 1 {
+		t.Errorf("stream opened %d times, want 1", gen.calls)
+	}
+}
+
+func TestEventStreamReportsDownscaleInImageEvent(t *testing.T) {
+	png := testPNG(t, 16, 16)
+	useGenerator(t, &fakeGenerator{responses: []*genai.GenerateContentResponse{
+		modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: png}}),
+	}})
+	previous := maxOutputWidth
+	maxOutputWidth = 8
+	t.Cleanup(func() { maxOutputWidth = previous })
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/text-to-image", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/event-stream")
+		rec := httptest.NewRecorder()
+		handleTextToImage(rec, req)
+		return rec
+	}
+
+	if rec := post(`{"prompt":"a red fox","optimize":true}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("optimize with SSE: status = %d, want 400", rec.Code)
+	}
+
+	rec := post(`{"prompt":"a red fox"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"downscaled":true`) {
+		t.Errorf("image event does not report the downscale: %q", rec.Body.String())
+	}
+}
+
+func TestTextToImageStopsStreamWhenClientCancels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	thought := modelResponse(&genai.Part{Text: "Sketching", Thought: true})
+	gen := &fakeGenerator{
+		responses: []*genai.GenerateContentResponse{
+			thought,
+			thought,
+			modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: testPNG(t, 8, 8)}}),
+		},
+		// El cliente se va mientras el modelo todavía está pensando
+		afterChunk: cancel,
+	}
+	useGenerator(t, gen)
+
+	req := httptest.NewRequest(http.MethodPost, "/text-to-image", strings.NewReader(`{"prompt":"a red fox"}`)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleTextToImage(rec, req)
+
+	if gen.streamed != 2 {
+		t.Errorf("stream emitted %d chunks, want the loop to stop at the first chunk after cancelling", gen.streamed)
+	}
+	if rec.Code != statusClientClosedRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, statusClientClosedRequest)
+	}
+	if body := decodeErrorBody(t, rec); body["code"] != codeClientClosedRequest {
+		t.Errorf("code = %q, want %q", body["code"], codeClientClosedRequest)
+	}
+}
+
+func TestDescribeUsesGenerator(t *testing.T) {
+	gen := &fakeGenerator{responses: []*genai.GenerateContentResponse{
+		modelResponse(&genai.Part{Text: "A red fox "}),
+		modelResponse(&genai.Part{Text: "in the snow."}),
+	}}
+	useGenerator(t, gen)
+	input := testPNG(t, 16, 16)
+
+	rec := postJSON(t, handleDescribe, "/describe", map[string]any{
+		"image_base64": base64.StdEncoding.EncodeToString(input),
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Description != "A red fox in the snow." {
+		t.Errorf("description = %q", body.Description)
+	}
+	if len(gen.contents) != 1 || len(gen.contents[0].Parts) != 2 || !bytes.Equal(gen.contents[0].Parts[0].InlineData.Data, input) {
+		t.Errorf("the input image was not sent to the model")
+	}
+}
+
+func TestDescribeWithoutGenerator(t *testing.T) {
+	useGenerator(t, nil)
+
+	rec := postJSON(t, handleDescribe, "/describe", map[string]any{
+		"image_base64": base64.StdEncoding.EncodeToString(testPNG(t, 16, 16)),
+	})
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestRejectPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"8.8.8.8:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.1:80", true},
+		{"[2606:4700::1111]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.100.100.200:80", false},
+		{"100.127.255.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fd00::1]:80", false},
+	}
+	for _, tt := range tests {
+		err := rejectPrivateAddress("tcp", tt.address, nil)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v (err %v)", tt.address, allowed, tt.allowed, err)
+		}
+	}
+}
+
+func TestSketchLayersRejectUnsupportedType(t *testing.T) {
+	gen := &fakeGenerator{}
+	useGenerator(t, gen)
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+
+	rec := postJSON(t, handleSketchToImage, "/sketch-to-image", map[string]any{
+		"sketches": []string{
+			base64.StdEncoding.EncodeToString(testPNG(t, 8, 8)),
+			base64.StdEncoding.EncodeToString(gif),
+		},
+		"description": "a house",
+	})
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want 415 (%s)", rec.Code, rec.Body.String())
+	}
+	body := decodeErrorBody(t, rec)
+	if body["code"] != codeUnsupportedMediaType || !strings.Contains(body["error"], "sketches[1]") {
+		t.Errorf("unexpected error body: %v", body)
+	}
+	if gen.calls != 0 {
+		t.Errorf("generator called with an unsupported layer")
+	}
+}
+
+// useUploadStore instala un almacén de subidas vacío en un directorio temporal y registra
+// las API keys indicadas.
+func useUploadStore(t *testing.T, quota int64, keys ...string) {
+	t.Helper()
+	previous := chunkedUploads
+	chunkedUploads = &uploadStore{
+		dir:     t.TempDir(),
+		ttl:     time.Hour,
+		maxSize: 1 << 20,
+		quota:   quota,
+		uploads: make(map[string]*chunkedUpload),
+	}
+	t.Cleanup(func() { chunkedUploads = previous })
+
+	keysMutex.Lock()
+	for _, key := range keys {
+		apiKeys[key] = &apiKeyInfo{Key: key, Limit: 20}
+	}
+	keysMutex.Unlock()
+	t.Cleanup(func() {
+		keysMutex.Lock()
+		for _, key := range keys {
+			delete(apiKeys, key)
+		}
+		keysMutex.Unlock()
+	})
+}
+
+func uploadRequest(method, target, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+	rec := httptest.NewRecorder()
+	if target == "/uploads" {
+		requireAPIKey(handleCreateUpload)(rec, req)
+	} else {
+		requireAPIKey(handleUpload)(rec, req)
+	}
+	return rec
+}
+
+func TestUploadsBelongToTheirAPIKey(t *testing.T) {
+	useUploadStore(t, 1<<20, "key-owner", "key-other")
+
+	rec := uploadRequest(http.MethodPost, "/uploads", "key-owner", `{"size": 4}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	location := rec.Header().Get("Location")
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if rec := uploadRequest(method, location, "key-other", "data"); rec.Code != http.StatusNotFound {
+			t.Errorf("%s with another key: status = %d, want 404", method, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, location, strings.NewReader("data"))
+	req.Header.Set("X-API-Key", "key-owner")
+	req.Header.Set("Upload-Offset", "0")
+	rec = httptest.NewRecorder()
+	requireAPIKey(handleUpload)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("owner PUT: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	id := strings.TrimPrefix(location, "/uploads/")
+	ownerCtx := context.WithValue(context.Background(), apiKeyContextKey{}, "key-owner")
+	otherCtx := context.WithValue(context.Background(), apiKeyContextKey{}, "key-other")
+	if _, err := requestImage(otherCtx, nil, "image", "", "", id); !errors.Is(err, errUploadNotFound) {
+		t.Errorf("image_upload_id with another key: err = %v, want errUploadNotFound", err)
+	}
+	if data, err := requestImage(ownerCtx, nil, "image", "", "", id); err != nil || string(data) != "data" {
+		t.Errorf("image_upload_id with the owner key: data = %q, err = %v", data, err)
+	}
+}
+
+func TestUploadQuotaPerAPIKey(t *testing.T) {
+	useUploadStore(t, 100, "key-a", "key-b")
+
+	if rec := uploadRequest(http.MethodPost, "/uploads", "key-a", `{"size": 60}`); rec.Code != http.StatusCreated {
+		t.Fatalf("first upload: status = %d", rec.Code)
+	}
+	rec := uploadRequest(http.MethodPost, "/uploads", "key-a", `{"size": 60}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: status = %d, want 429", rec.Code)
+	}
+	if body := decodeErrorBody(t, rec); body["code"] != codeUploadQuotaExceeded {
+		t.Errorf("code = %q, want %q", body["code"], codeUploadQuotaExceeded)
+	}
+	if rec := uploadRequest(http.MethodPost, "/uploads", "key-b", `{"size": 60}`); rec.Code != http.StatusCreated {
+		t.Errorf("another key: status = %d, want 201", rec.Code)
+	}
+}
+
+func TestUploadExpiryDoesNotRaceChunks(t *testing.T) {
+	useUploadStore(t, 1<<20, "key-race")
+	// Con un TTL tan corto las subidas caducan entre trozo y trozo mientras expire barre
+	chunkedUploads.ttl = 100 * time.Microsecond
+
+	stop := make(chan struct{})
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				chunkedUploads.expire()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := uploadRequest(http.MethodPost, "/uploads", "key-race", `{"size": 64}`)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("create: status = %d (%s)", rec.Code, rec.Body.String())
+				return
+			}
+			location := rec.Header().Get("Location")
+			for offset := 0; offset < 64; offset += 4 {
+				req := httptest.NewRequest(http.MethodPut, location, strings.NewReader("abcd"))
+				req.Header.Set("X-API-Key", "key-race")
+				req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+				rec := httptest.NewRecorder()
+				requireAPIKey(handleUpload)(rec, req)
+				switch rec.Code {
+				case http.StatusOK:
+				case http.StatusNotFound:
+					return
+				default:
+					t.Errorf("PUT at %d: status = %d (%s)", offset, rec.Code, rec.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-swept
+}
+
+// useAPIKey registra una API key con el límite dado durante el test.
+func useAPIKey(t *testing.T, key string, limit int) *apiKeyInfo {
+	t.Helper()
+	info := &apiKeyInfo{Key: key, Limit: limit}
+	keysMutex.Lock()
+	apiKeys[key] = info
+	keysMutex.Unlock()
+	t.Cleanup(func() {
+		keysMutex.Lock()
+		delete(apiKeys, key)
+		keysMutex.Unlock()
+	})
+	return info
+}
+
+// postWithAPIKey hace la petición a través de validateAPIKey, que cobra la primera llamada.
+func postWithAPIKey(handler http.HandlerFunc, target, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+	rec := httptest.NewRecorder()
+	validateAPIKey(handler)(rec, req)
+	return rec
+}
+
+// flakyGenerator falla las primeras failures llamadas y después devuelve image. Admite
+// llamadas concurrentes, a diferencia de fakeGenerator.
+type flakyGenerator struct {
+	mu       sync.Mutex
+	failures int
+	image    []byte
+	calls    int
+}
+
+func (g *flakyGenerator) Generate(ctx context.Context, prompt string, images []inputImage) ([]byte, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls++
+	if g.calls <= g.failures {
+		return nil, "", errors.New("upstream failure")
+	}
+	return g.image, "image/png", nil
+}
+
+func (g *flakyGenerator) GenerateStream(ctx context.Context, contents []*genai.Content, config *genai.GenerateContentConfig) iter.Seq2[*genai.GenerateContentResponse, error] {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		yield(nil, errors.New("not implemented"))
+	}
+}
+
+func TestVariationsChargeOneCallPerImage(t *testing.T) {
+	gen := &flakyGenerator{failures: 1, image: testPNG(t, 8, 8)}
+	useGenerator(t, gen)
+
+	info := useAPIKey(t, "key-variations", 5)
+	rec := postWithAPIKey(handleVariations, "/variations", "key-variations", `{"prompt":"a lighthouse","count":3}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	// Tres variaciones reservadas y una fallida devuelta
+	if info.Used != 2 {
+		t.Errorf("used = %d, want 2", info.Used)
+	}
+
+	rec = postWithAPIKey(handleVariations, "/variations", "key-variations", `{"prompt":"a lighthouse","count":4}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: status = %d, want 429", rec.Code)
+	}
+	if body := decodeErrorBody(t, rec); body["code"] != codeQuotaExceeded {
+		t.Errorf("code = %q, want %q", body["code"], codeQuotaExceeded)
+	}
+	if info.Used != 2 || gen.calls != 3 {
+		t.Errorf("rejected request: used = %d, calls = %d, want 2 and 3", info.Used, gen.calls)
+	}
+}
+
+func TestBatchChargesOneCallPerPrompt(t *testing.T) {
+	gen := &flakyGenerator{failures: 1, image: testPNG(t, 8, 8)}
+	useGenerator(t, gen)
+
+	info := useAPIKey(t, "key-batch", 4)
+	rec := postWithAPIKey(handleBatch, "/batch", "key-batch", `{"prompts":["a cat","a dog","a fox","an owl","a bee"]}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: status = %d, want 429", rec.Code)
+	}
+	if info.Used != 0 || gen.calls != 0 {
+		t.Errorf("rejected batch: used = %d, calls = %d, want 0 and 0", info.Used, gen.calls)
+	}
+
+	rec = postWithAPIKey(handleBatch, "/batch", "key-batch", `{"prompts":["a cat","a dog","a fox"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if info.Used != 2 {
+		t.Errorf("used = %d, want 2 (3 prompts, 1 failed)", info.Used)
+	}
+}
+
+func TestCandidatesChargeOneCallPerImage(t *testing.T) {
+	png := testPNG(t, 8, 8)
+	resp := modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: png}})
+	// El tercer candidato viene bloqueado y se descarta
+	resp.Candidates = append(resp.Candidates,
+		&genai.Candidate{Index: 1, Content: &genai.Content{Role: "model", Parts: []*genai.Part{{InlineData: &genai.Blob{MIMEType: "image/png", Data: png}}}}},
+		&genai.Candidate{Index: 2, FinishReason: genai.FinishReasonSafety},
+	)
+	useGenerator(t, &fakeGenerator{responses: []*genai.GenerateContentResponse{resp}})
+
+	info := useAPIKey(t, "key-candidates", 4)
+	rec := postWithAPIKey(handleTextToImage, "/text-to-image", "key-candidates", `{"prompt":"a red fox","candidate_count":3}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if info.Used != 2 {
+		t.Errorf("used = %d, want 2 (3 candidates, 1 discarded)", info.Used)
+	}
+
+	rec = postWithAPIKey(handleTextToImage, "/text-to-image", "key-candidates", `{"prompt":"a red fox","candidate_count":3}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: status = %d, want 429", rec.Code)
+	}
+	if info.Used != 2 {
+		t.Errorf("rejected request: used = %d, want 2", info.Used)
+	}
+}
+
+func TestJSONResponseIncludesSafetyRatings(t *testing.T) {
+	image := modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: testPNG(t, 8, 8)}})
+	image.Candidates[0].SafetyRatings = []*genai.SafetyRating{
+		{Category: genai.HarmCategoryDangerousContent, Probability: genai.HarmProbabilityLow},
+	}
+	useGenerator(t, &fakeGenerator{responses: []*genai.GenerateContentResponse{image}})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/text-to-image?format=json", strings.NewReader(`{"prompt":"a red fox"}`))
+	req.Header.Set("Content-Type", "application/json")
+	withSafetyRatings(handleTextToImage)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		SafetyRatings []safetyRating `json:"safety_ratings"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := safetyRating{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "LOW"}
+	if len(body.SafetyRatings) != 1 || body.SafetyRatings[0] != want {
+		t.Errorf("safety_ratings = %+v, want [%+v]", body.SafetyRatings, want)
+	}
+}
+
+func TestJobLongPollingReturnsWhenJobFinishes(t *testing.T) {
+	previous := asyncJobStore
+	asyncJobStore = newJobStore(time.Hour)
+	t.Cleanup(func() { asyncJobStore = previous })
+
+	asyncJobStore.create("job-1")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		asyncJobStore.finish(&asyncResult{JobID: "job-1", Status: jobStatusDone, MIMEType: "image/png"})
+	}()
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handleJob(rec, httptest.NewRequest(http.MethodGet, "/jobs/job-1?wait=5", nil))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("long poll took %s, want it to return when the job finished", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), `"status":"done"`) {
+		t.Errorf("body = %s, want the finished job", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handleJob(rec, httptest.NewRequest(http.MethodGet, "/jobs/job-1?wait=600", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("wait=600: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestJobLongPollingReportsCurrentStatusOnTimeout(t *testing.T) {
+	previous := asyncJobStore
+	asyncJobStore = newJobStore(time.Hour)
+	t.Cleanup(func() { asyncJobStore = previous })
+
+	asyncJobStore.create("job-1")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		asyncJobStore.setRunning("job-1")
+	}()
+
+	rec := httptest.NewRecorder()
+	handleJob(rec, httptest.NewRequest(http.MethodGet, "/jobs/job-1?wait=1", nil))
+	if !strings.Contains(rec.Body.String(), `"status":"running"`) {
+		t.Errorf("body = %s, want the job as running", rec.Body.String())
+	}
+}
+
+func TestModelProbeAdjustsAllowlists(t *testing.T) {
+	lookup := func(ctx context.Context, model string) (*genai.Model, error) {
+		switch model {
+		case "default-model":
+			return &genai.Model{SupportedActions: []string{"generateContent"}, MaxTemperature: 1}, nil
+		case "missing-model":
+			return nil, genai.APIError{Code: http.StatusNotFound, Status: "NOT_FOUND"}
+		case "embedding-model":
+			return &genai.Model{SupportedActions: []string{"embedContent"}}, nil
+		}
+		return nil, errors.New("connection reset")
+	}
+	probed, allowed := probeModels(context.Background(), lookup, "default-model", []string{"missing-model", "embedding-model", "flaky-model"})
+
+	// Un fallo que no es un 404 deja el modelo con los límites fijos
+	if !slices.Equal(allowed, []string{"flaky-model"}) {
+		t.Errorf("allowed = %v, want [flaky-model]", allowed)
+	}
+	previousProbed, previousModel := probedModels, modelName
+	probedModels, modelName = probed, "default-model"
+	t.Cleanup(func() { probedModels, modelName = previousProbed, previousModel })
+
+	if got := maxTemperatureFor("flaky-model"); got != defaultMaxTemperature {
+		t.Errorf("flaky-model max temperature = %g, want the static %d", got, defaultMaxTemperature)
+	}
+	useGenerator(t, &fakeGenerator{image: testPNG(t, 8, 8), mimeType: "image/png"})
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "temperature": 1.5})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("temperature above the probed maximum: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestMultipartFillsCommonImageOptions(t *testing.T) {
+	useGenerator(t, &fakeGenerator{image: testPNG(t, 8, 8), mimeType: "image/png"})
+
+	post := func(fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, err := mw.CreateFormFile("image", "photo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(testPNG(t, 8, 8))
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/magic-eraser", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handleMagicEraser(rec, req)
+		return rec
+	}
+
+	rec := post(map[string]string{"priority": "urgent"})
+	if body := decodeErrorBody(t, rec); rec.Code != http.StatusBadRequest || body["error"] != "priority must be high, normal or low" {
+		t.Errorf("priority: status = %d, body = %v", rec.Code, body)
+	}
+	rec = post(map[string]string{"output_format": "jpeg", "output_quality": "80"})
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("output_format: status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestStorageKeyStrategies(t *testing.T) {
+	previousStore, previousStrategy := imageStorage, storageKeyStrategy
+	t.Cleanup(func() { imageStorage, storageKeyStrategy = previousStore, previousStrategy })
+	imageStorage = &localStore{dir: t.TempDir(), baseURL: "/images"}
+
+	data := testPNG(t, 4, 4)
+	ctx := context.WithValue(context.Background(), storagePromptContextKey{}, "Un zorro rojo, en la nieve!")
+
+	storageKeyStrategy = storageKeyContentHash
+	first, err := storeImage(ctx, data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := storeImage(ctx, data, "image/png"); second != first {
+		t.Errorf("content-hash: same image stored as %q and %q", first, second)
+	}
+
+	storageKeyStrategy = storageKeyUUID
+	if url, _ := storeImage(ctx, data, "image/png"); url == first {
+		t.Errorf("uuid: got the content-hash URL %q", url)
+	}
+
+	storageKeyStrategy = storageKeyPromptSlug
+	url, err := storeImage(ctx, data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(url, "/images/un-zorro-rojo-en-la-nieve-") || !strings.HasSuffix(url, ".jpg") {
+		t.Errorf("prompt-slug: url = %q", url)
+	}
+}
+
+func TestConvertOutputFlattensTransparencyOntoBackground(t *testing.T) {
+	data, err := encodePNG(image.NewNRGBA(image.Rect(0, 0, 8, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		background string
+		want       color.RGBA
+	}{
+		{"", color.RGBA{255, 255, 255, 255}},
+		{"#ff0000", color.RGBA{255, 0, 0, 255}},
+	} {
+		out, mimeType, err := convertOutput(data, "image/png", "jpeg", 100, tc.background)
+		if err != nil || mimeType != "image/jpeg" {
+			t.Fatalf("background %q: mime %q, err %v", tc.background, mimeType, err)
+		}
+		img, err := decodeImage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// JPEG es con pérdida: se admite una pequeña diferencia por canal
+		got := color.RGBAModel.Convert(img.At(4, 4)).(color.RGBA)
+		for _, channel := range [][2]uint8{{got.R, tc.want.R}, {got.G, tc.want.G}, {got.B, tc.want.B}} {
+			if diff := int(channel[0]) - int(channel[1]); diff < -6 || diff > 6 {
+				t.Errorf("background %q: pixel = %v, want about %v", tc.background, got, tc.want)
+				break
+			}
+		}
+	}
+
+	if err := validOutputFormat("jpeg", 0, "blue", false); err == nil {
+		t.Error("background_color=blue was accepted")
+	}
+}
+
+func TestPromptLengthPolicy(t *testing.T) {
+	previousLength, previousPolicy := maxPromptLength, promptLengthPolicy
+	t.Cleanup(func() { maxPromptLength, promptLengthPolicy = previousLength, previousPolicy })
+	maxPromptLength = 10
+	gen := &fakeGenerator{image: testPNG(t, 8, 8), mimeType: "image/png"}
+	useGenerator(t, gen)
+
+	promptLengthPolicy = promptLengthReject
+	if rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox in the snow"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reject: status = %d, want 400", rec.Code)
+	}
+
+	promptLengthPolicy = promptLengthTruncate
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox in the snow"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("truncate: status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Prompt-Truncated"); got != "prompt" {
+		t.Errorf("X-Prompt-Truncated = %q, want %q", got, "prompt")
+	}
+	if !strings.Contains(gen.prompt, "a red fox ") || strings.Contains(gen.prompt, "snow") {
+		t.Errorf("prompt sent to the model = %q, want it truncated to 10 characters", gen.prompt)
+	}
+}
+
+func TestPreviewReturnsDraftAndUpgradeWaitsForFinalImage(t *testing.T) {
+	draft, final := testPNG(t, 4, 4), testPNG(t, 16, 16)
+	responses := []*genai.GenerateContentResponse{
+		modelResponse(&genai.Part{Thought: true, InlineData: &genai.Blob{MIMEType: "image/png", Data: draft}}),
+		modelResponse(&genai.Part{InlineData: &genai.Blob{MIMEType: "image/png", Data: final}}),
+	}
+
+	useGenerator(t, &fakeGenerator{responses: responses})
+	rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "preview": true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview: status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(rec.Body.Bytes(), draft) || rec.Header().Get("X-Preview") != "true" {
+		t.Errorf("preview: want the draft image with X-Preview: true")
+	}
+	seed := rec.Header().Get("X-Seed")
+	if seed == "" {
+		t.Fatal("preview: missing X-Seed")
+	}
+
+	if rec := postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "upgrade": true}); rec.Code != http.StatusBadRequest {
+		t.Errorf("upgrade without seed: status = %d, want 400", rec.Code)
+	}
+
+	useGenerator(t, &fakeGenerator{responses: responses})
+	rec = postJSON(t, handleTextToImage, "/text-to-image", map[string]any{"prompt": "a red fox", "upgrade": true, "seed": json.Number(seed)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upgrade: status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(rec.Body.Bytes(), final) || rec.Header().Get("X-Seed") != seed {
+		t.Errorf("upgrade: want the final image with X-Seed %s", seed)
+	}
+}
+
+func TestLocalSignedImageURLs(t *testing.T) {
+	previousTTL := storageURLTTL
+	t.Cleanup(func() { storageURLTTL = previousTTL })
+	storageURLTTL = time.Minute
+
+	store := &localStore{dir: t.TempDir(), baseURL: "/images", urlKey: []byte("secret")}
+	if err := store.save(context.Background(), "fox.png", testPNG(t, 4, 4), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	handler := storedImagesHandler(store)
+	get := func(target string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+
+	if code := get(store.signedURL("fox.png", time.Now().Add(time.Minute))); code != http.StatusOK {
+		t.Errorf("signed URL: status = %d, want 200", code)
+	}
+	if code := get("/images/fox.png"); code != http.StatusForbidden {
+		t.Errorf("unsigned URL: status = %d, want 403", code)
+	}
+	if code := get(store.signedURL("fox.png", time.Now().Add(-time.Second))); code != http.StatusForbidden {
+		t.Errorf("expired URL: status = %d, want 403", code)
+	}
+	tampered := strings.Replace(store.signedURL("fox.png", time.Now().Add(time.Minute)), "expires=", "expires=9", 1)
+	if code := get(tampered); code != http.StatusForbidden {
+		t.Errorf("tampered URL: status = %d, want 403", code)
+	}
+}
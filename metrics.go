@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Límites superiores (en segundos) de los buckets del histograma de latencia. Una
+// generación tarda normalmente entre 5 y 60 segundos.
+var latencyBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+// requestMetrics acumula los contadores y el histograma que se exponen en /metrics
+// con el formato de texto de Prometheus.
+type requestMetrics struct {
+	mu        sync.Mutex
+	requests  map[metricsKey]int
+	errors    map[errorsKey]int
+	latencies map[string]*latencyHistogram
+}
+
+type metricsKey struct {
+	endpoint string
+	status   int
+}
+
+type errorsKey struct {
+	endpoint string
+	class    string
+}
+
+// Clases de estado: los 4xx son fallos del cliente (validación, API key, cuota) y los
+// 5xx del servidor o de Google, y se cuentan por separado
+const (
+	statusClassSuccess     = "success"
+	statusClassClientError = "client_error"
+	statusClassServerError = "server_error"
+)
+
+func statusClass(status int) string {
+	switch {
+	case status >= 500:
+		return statusClassServerError
+	case status >= 400:
+		return statusClassClientError
+	default:
+		return statusClassSuccess
+	}
+}
+
+type latencyHistogram struct {
+	counts []int
+	sum    float64
+	count  int
+}
+
+var metrics = &requestMetrics{
+	requests:  make(map[metricsKey]int),
+	errors:    make(map[errorsKey]int),
+	latencies: make(map[string]*latencyHistogram),
+}
+
+func (m *requestMetrics) observe(endpoint string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[metricsKey{endpoint, status}]++
+	if class := statusClass(status); class != statusClassSuccess {
+		m.errors[errorsKey{endpoint, class}]++
+	}
+
+	histogram, ok := m.latencies[endpoint]
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]int, len(latencyBuckets))}
+		m.latencies[endpoint] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+func (m *requestMetrics) write(w *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.WriteString("# HELP image_api_requests_total Total HTTP requests by endpoint and status code.\n")
+	w.WriteString("# TYPE image_api_requests_total counter\n")
+	keys := make([]metricsKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "image_api_requests_total{endpoint=%q,status=\"%d\"} %d\n", key.endpoint, key.status, m.requests[key])
+	}
+
+	w.WriteString("# HELP image_api_request_errors_total HTTP requests answered with a 4xx (class client_error) or 5xx (class server_error) status.\n")
+	w.WriteString("# TYPE image_api_request_errors_total counter\n")
+	errorKeys := make([]errorsKey, 0, len(m.errors))
+	for key := range m.errors {
+		errorKeys = append(errorKeys, key)
+	}
+	sort.Slice(errorKeys, func(i, j int) bool {
+		if errorKeys[i].endpoint != errorKeys[j].endpoint {
+			return errorKeys[i].endpoint < errorKeys[j].endpoint
+		}
+		return errorKeys[i].class < errorKeys[j].class
+	})
+	for _, key := range errorKeys {
+		fmt.Fprintf(w, "image_api_request_errors_total{endpoint=%q,class=%q} %d\n", key.endpoint, key.class, m.errors[key])
+	}
+
+	w.WriteString("# HELP image_api_request_duration_seconds HTTP request latency.\n")
+	w.WriteString("# TYPE image_api_request_duration_seconds histogram\n")
+	for _, endpoint := range sortedKeys(m.latencies) {
+		histogram := m.latencies[endpoint]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "image_api_request_duration_seconds_bucket{endpoint=%q,le=%q} %d\n", endpoint, strconv.FormatFloat(bound, 'g', -1, 64), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "image_api_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n", endpoint, histogram.count)
+		fmt.Fprintf(w, "image_api_request_duration_seconds_sum{endpoint=%q} %g\n", endpoint, histogram.sum)
+		fmt.Fprintf(w, "image_api_request_duration_seconds_count{endpoint=%q} %d\n", endpoint, histogram.count)
+	}
+}
+
+// writePacerMetrics expone el estado del pacer como gauges. Sin PACER_RPM no se escribe
+// nada.
+func writePacerMetrics(w *strings.Builder) {
+	if generationPacer == nil {
+		return
+	}
+	targetRPM, currentRPM, queued := generationPacer.stats()
+
+	w.WriteString("# HELP image_api_pacer_target_rpm Configured genai calls per minute (PACER_RPM).\n")
+	w.WriteString("# TYPE image_api_pacer_target_rpm gauge\n")
+	fmt.Fprintf(w, "image_api_pacer_target_rpm %g\n", targetRPM)
+	w.WriteString("# HELP image_api_pacer_current_rpm Current genai calls per minute after backing off on 429s.\n")
+	w.WriteString("# TYPE image_api_pacer_current_rpm gauge\n")
+	fmt.Fprintf(w, "image_api_pacer_current_rpm %g\n", currentRPM)
+	w.WriteString("# HELP image_api_pacer_queue_depth genai calls waiting for their pacer slot.\n")
+	w.WriteString("# TYPE image_api_pacer_queue_depth gauge\n")
+	fmt.Fprintf(w, "image_api_pacer_queue_depth %d\n", queued)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withMetrics registra cada petición bajo el patrón de ruta del mux que la atiende,
+// no bajo la URL recibida, para que rutas inexistentes no creen series nuevas. Las que
+// caen en el catch-all "/" cuentan como "unmatched".
+func withMetrics(mux *http.ServeMux, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		if endpoint == "" || endpoint == "/" {
+			endpoint = "unmatched"
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.observe(endpoint, status, time.Since(start))
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, codeMethodNotAllowed, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body strings.Builder
+	metrics.write(&body)
+	writePacerMetrics(&body)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(body.String()))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Moderación local previa: los prompts que contienen un término de la lista se rechazan
+// sin llamar al modelo. Sin lista configurada no se comprueba nada.
+type blockedTerm struct {
+	term    string
+	pattern *regexp.Regexp
+}
+
+var promptBlocklist []blockedTerm
+
+// loadPromptBlocklist combina los términos de PROMPT_BLOCKLIST con los del fichero
+// PROMPT_BLOCKLIST_FILE (uno por línea; las vacías y las que empiezan por # se ignoran).
+func loadPromptBlocklist(terms []string, path string) error {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				terms = append(terms, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	promptBlocklist = nil
+	for _, term := range terms {
+		words := strings.Fields(term)
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		// Límites de palabra propios: \b solo conoce ASCII y fallaría con tildes y eñes.
+		// Los espacios de una frase admiten cualquier cantidad de espacios en el prompt.
+		pattern := regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])` + strings.Join(words, `\s+`) + `(?:$|[^\p{L}\p{N}_])`)
+		promptBlocklist = append(promptBlocklist, blockedTerm{term: term, pattern: pattern})
+	}
+	if len(promptBlocklist) > 0 {
+		log.Printf("Prompt blocklist enabled (%d terms)", len(promptBlocklist))
+	}
+	return nil
+}
+
+// blockedPromptTerm devuelve el primer término de la lista que aparece como palabra o
+// frase completa en el prompt, sin distinguir mayúsculas, o "" si no hay ninguno.
+func blockedPromptTerm(prompt string) string {
+	for _, blocked := range promptBlocklist {
+		if blocked.pattern.MatchString(prompt) {
+			return blocked.term
+		}
+	}
+	return ""
+}
+
+// writePromptRejected responde 422 sin revelar qué término coincidió; el término solo
+// se registra en el log.
+func writePromptRejected(ctx context.Context, w http.ResponseWriter, field, term string) {
+	logf(ctx, "Rejected %s: matched blocklist term %q", field, term)
+	writeError(w, codePromptRejected, "prompt rejected by content policy", http.StatusUnprocessableEntity)
+}
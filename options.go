@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// generationOptions son los parámetros de generación que admiten todos los endpoints que
+// llaman al modelo. Se incrustan en cada request para validarlos en un solo sitio.
+type generationOptions struct {
+	Priority string `json:"priority,omitempty"`
+	Model    string `json:"model,omitempty"`
+}
+
+func (o generationOptions) validate() error {
+	if !validPriority(o.Priority) {
+		return errors.New("priority must be high, normal or low")
+	}
+	return checkModel(o.Model)
+}
+
+// commonImageOptions añade a generationOptions los parámetros de salida de los endpoints
+// que devuelven una sola imagen, que se aplican con writeProcessedImage.
+type commonImageOptions struct {
+	generationOptions
+	Optimize        bool   `json:"optimize,omitempty"`
+	OutputFormat    string `json:"output_format,omitempty"`
+	OutputQuality   int    `json:"output_quality,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+}
+
+func (o commonImageOptions) validate() error {
+	if err := validOutputFormat(o.OutputFormat, o.OutputQuality, o.BackgroundColor, o.Optimize); err != nil {
+		return err
+	}
+	return o.generationOptions.validate()
+}
+
+// writeProcessedImage es el final común de los endpoints de imagen: marca de agua,
+// optimize, output_format y escritura de la respuesta.
+func writeProcessedImage(ctx context.Context, w http.ResponseWriter, r *http.Request, img []byte, mimeType string, opts commonImageOptions, watermark watermarkOption) {
+	img, mimeType, err := applyWatermark(img, mimeType, watermark)
+	if err != nil {
+		logf(ctx, "Error applying watermark: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("watermark error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	img, mimeType = optimizeOutput(ctx, w, opts.Optimize, img, mimeType)
+	img, mimeType, err = convertOutput(img, mimeType, opts.OutputFormat, opts.OutputQuality, opts.BackgroundColor)
+	if err != nil {
+		logf(ctx, "Error converting output: %v", err)
+		writeError(w, codeInternalError, fmt.Sprintf("output conversion error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeImage(w, r, img, mimeType)
+}
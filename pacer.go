@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// Ritmo mínimo al que puede bajar el pacer tras encadenar 429
+	minPacerRPM = 1.0
+	// Fracción del ritmo objetivo que se recupera por cada minuto sin 429
+	pacerRecoveryPerMinute = 0.1
+)
+
+// pacer espacia las llamadas a genai para no superar un número de peticiones por
+// minuto. Funciona como un leaky bucket: cada llamada reserva el siguiente hueco
+// libre, separado 1/RPM minutos del anterior, y espera hasta que llega su turno.
+// Cuando genai responde 429 el ritmo se reduce a la mitad y después se recupera
+// linealmente (un 10% del objetivo por minuto) hasta volver al RPM configurado.
+type pacer struct {
+	mu         sync.Mutex
+	targetRPM  float64
+	currentRPM float64
+	nextSlot   time.Time
+	lastAdjust time.Time
+	queued     int
+}
+
+func newPacer(rpm float64) *pacer {
+	return &pacer{
+		targetRPM:  rpm,
+		currentRPM: rpm,
+		lastAdjust: time.Now(),
+	}
+}
+
+// wait bloquea hasta que la llamada puede salir o el contexto se cancela.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	p.recover(now)
+	slot := p.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	p.nextSlot = slot.Add(time.Duration(float64(time.Minute) / p.currentRPM))
+	p.queued++
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.queued--
+		p.mu.Unlock()
+	}()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onRateLimited reduce el ritmo a la mitad tras un 429 de genai.
+func (p *pacer) onRateLimited() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.recover(time.Now())
+	p.currentRPM = max(p.currentRPM/2, minPacerRPM)
+	log.Printf("genai rate limited, pacing reduced to %.1f RPM", p.currentRPM)
+}
+
+// recover sube el ritmo según el tiempo transcurrido desde el último ajuste. Requiere p.mu.
+func (p *pacer) recover(now time.Time) {
+	elapsed := now.Sub(p.lastAdjust).Minutes()
+	p.lastAdjust = now
+	p.currentRPM = min(p.targetRPM, p.currentRPM+p.targetRPM*pacerRecoveryPerMinute*elapsed)
+}
+
+func (p *pacer) stats() (float64, float64, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.recover(time.Now())
+	return p.targetRPM, p.currentRPM, p.queued
+}
+
+// reportUpstreamError informa al pacer de los errores de cuota de genai.
+func reportUpstreamError(err error) {
+	if generationPacer == nil {
+		return
+	}
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusTooManyRequests || apiErr.Status == "RESOURCE_EXHAUSTED") {
+		generationPacer.onRateLimited()
+	}
+}
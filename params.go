@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// generationParams son los parámetros de muestreo que el cliente puede fijar en el
+// body. Los campos nil no se envían y el modelo usa sus valores por defecto.
+type generationParams struct {
+	Seed        *int32
+	Temperature *float32
+	TopP        *float32
+	AspectRatio string
+
+	// Candidatos por llamada; 0 o 1 = uno solo, como siempre
+	CandidateCount int32
+
+	// Preview devuelve el primer borrador que emite el modelo en lugar de esperar a la
+	// imagen final
+	Preview bool
+}
+
+// Relaciones de aspecto que admite ImageConfig
+var aspectRatios = []string{"1:1", "2:3", "3:2", "3:4", "4:3", "9:16", "16:9", "21:9"}
+
+func validAspectRatio(ratio string) bool {
+	return slices.Contains(aspectRatios, ratio)
+}
+
+type generationParamsContextKey struct{}
+
+// randomSeed elige una semilla para las peticiones que necesitan poder repetirse.
+func randomSeed() *int32 {
+	seed := rand.Int32()
+	return &seed
+}
+
+func withGenerationParams(ctx context.Context, params generationParams) context.Context {
+	return context.WithValue(ctx, generationParamsContextKey{}, params)
+}
+
+func generationParamsFromContext(ctx context.Context) generationParams {
+	params, _ := ctx.Value(generationParamsContextKey{}).(generationParams)
+	return params
+}
+
+// Modalidades de respuesta que se pueden pedir al modelo
+const (
+	modalityImage = "IMAGE"
+	modalityText  = "TEXT"
+)
+
+// newGenerationConfig construye la configuración de una llamada con las modalidades
+// indicadas. Si se pide imagen, incluye el tamaño de la petición.
+func newGenerationConfig(ctx context.Context, modalities ...string) *genai.GenerateContentConfig {
+	config := &genai.GenerateContentConfig{
+		ResponseModalities: modalities,
+	}
+	if slices.Contains(modalities, modalityImage) {
+		config.ImageConfig = &genai.ImageConfig{
+			ImageSize: imageSizeFor(ctx),
+		}
+	}
+	applyGenerationParams(ctx, config)
+	return config
+}
+
+// imageModalities devuelve las modalidades de los endpoints que producen una imagen:
+// solo IMAGE, salvo que la petición aproveche el texto del modelo (alt text o eventos
+// de progreso del streaming SSE).
+func imageModalities(ctx context.Context) []string {
+	if altTextFromContext(ctx) != nil || progressFromContext(ctx) != nil {
+		return []string{modalityImage, modalityText}
+	}
+	return []string{modalityImage}
+}
+
+// applyGenerationParams copia en config los parámetros de la petición.
+func applyGenerationParams(ctx context.Context, config *genai.GenerateContentConfig) {
+	params := generationParamsFromContext(ctx)
+	if params.Seed != nil {
+		config.Seed = params.Seed
+	}
+	if params.Temperature != nil {
+		config.Temperature = params.Temperature
+	}
+	if params.TopP != nil {
+		config.TopP = params.TopP
+	}
+	if params.CandidateCount > 1 {
+		config.CandidateCount = params.CandidateCount
+	}
+	if params.Preview {
+		// Los borradores llegan como partes "thought", que solo se envían si se piden
+		config.ThinkingConfig = &genai.ThinkingConfig{IncludeThoughts: true}
+	}
+	if params.AspectRatio != "" {
+		if config.ImageConfig == nil {
+			config.ImageConfig = &genai.ImageConfig{}
+		}
+		config.ImageConfig.AspectRatio = params.AspectRatio
+	}
+}
+
+// cacheKey serializa los parámetros fijados para incluirlos en la clave de la caché.
+func (p generationParams) cacheKey() string {
+	var fields []string
+	if p.Seed != nil {
+		fields = append(fields, fmt.Sprintf("seed=%d", *p.Seed))
+	}
+	if p.Temperature != nil {
+		fields = append(fields, fmt.Sprintf("temperature=%g", *p.Temperature))
+	}
+	if p.TopP != nil {
+		fields = append(fields, fmt.Sprintf("top_p=%g", *p.TopP))
+	}
+	if p.AspectRatio != "" {
+		fields = append(fields, "aspect_ratio="+p.AspectRatio)
+	}
+	if p.CandidateCount > 1 {
+		fields = append(fields, fmt.Sprintf("candidates=%d", p.CandidateCount))
+	}
+	if p.Preview {
+		fields = append(fields, "preview")
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// promptData son los valores que pueden usar las plantillas de prompt. Todas reciben la
+// misma estructura; los campos que no aplican a un endpoint quedan vacíos.
+type promptData struct {
+	Prompt         string
+	NegativePrompt string
+	Description    string
+	Scale          float64
+	Amount         int
+	Direction      string
+	Width          int
+	Height         int
+}
+
+// Instrucciones por defecto que se envían al modelo en cada endpoint
+var defaultPromptTemplates = map[string]string{
+	"negative-prompt": "{{.Prompt}} Do not include any of the following: {{.NegativePrompt}}.",
+	"resize":          "Resize this image by x{{.Scale}} preserving details.",
+	"resize-enhance":  "Resize this image by x{{.Scale}}, sharpening edges and enhancing fine details and textures while keeping the content, colors and composition unchanged.",
+	"resize-denoise":  "Resize this image by x{{.Scale}}, removing noise, grain and compression artifacts while preserving real details and keeping the content, colors and composition unchanged.",
+	"upscale": "Upscale this photo by x{{.Scale}} to {{.Width}}x{{.Height}} pixels using super-resolution. " +
+		"Reconstruct fine detail such as skin texture, hair, fabric and foliage faithfully to the original, and remove noise and compression artifacts without over-smoothing. " +
+		"Preserve faces exactly: do not change facial features, expressions or identities. " +
+		"Do not invent, rewrite or sharpen text, logos or signage into new characters; keep existing text only as legible as the source allows. " +
+		"Keep colors, lighting, composition and framing unchanged, and do not add, remove or move anything.",
+	"sketch-to-image": "Interpret this sketch as '{{.Description}}'.",
+	"magic-eraser":    "Remove the pink masked area and reconstruct the background.",
+	// A diferencia de sketch-to-image, en colorize el contenido de la foto no debe cambiar
+	"colorize": "Colorize this black-and-white photo with natural, realistic colors. Keep everything else exactly as it is: same content, composition, framing, faces, textures and details. Do not add, remove or restyle anything; only add color.",
+	"inpaint": "The first image is the source image and the second image is a mask: white pixels mark the region to regenerate and black pixels must stay unchanged. " +
+		"{{if .Prompt}}Replace the content in the masked region with: {{.Prompt}}.{{else}}Remove the content in the masked region and reconstruct the background.{{end}}" +
+		" Blend the result seamlessly with the rest of the image.",
+	"style-transfer": "The first image is the content image and the second image is the style reference. " +
+		"Redraw the content image in the visual style of the style reference: its color palette, brushwork, textures and lighting. " +
+		"Keep the composition, subjects and layout of the content image, and do not copy any subjects from the style reference.",
+	"replace-subject": "The first image is the base image and the second image is the reference. " +
+		"In the base image, {{.Prompt}}. Take the appearance of the new subject from the reference image. " +
+		"Keep everything else in the base image unchanged: background, composition, framing, pose and the other subjects. " +
+		"Match the lighting, shadows, color grading, scale and perspective of the base image so that the result looks like a single, unedited photograph, " +
+		"and do not copy the background of the reference image.",
+	"extend":   "Extend the canvas of this image by {{.Amount}} pixels {{.Direction}}. Keep the original image unchanged and fill the new area so that it continues the scene seamlessly, matching its style, lighting and perspective.",
+	"describe": "Describe this image in detail: its subject, setting, colors, composition and any visible text. Reply with the description only.",
+}
+
+var promptTemplates map[string]*template.Template
+
+// loadPromptTemplates compila las plantillas por defecto y las sustituye por las de
+// PROMPT_TEMPLATES_FILE (un JSON {"nombre": "plantilla"}) y, con más prioridad, por las
+// variables PROMPT_TEMPLATE_<NOMBRE> (p. ej. PROMPT_TEMPLATE_SKETCH_TO_IMAGE).
+func loadPromptTemplates() error {
+	sources := make(map[string]string, len(defaultPromptTemplates))
+	for name, text := range defaultPromptTemplates {
+		sources[name] = text
+	}
+
+	if path := os.Getenv("PROMPT_TEMPLATES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var overrides map[string]string
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for name, text := range overrides {
+			if _, ok := defaultPromptTemplates[name]; !ok {
+				return fmt.Errorf("%s: unknown prompt template %q (known: %s)", path, name, strings.Join(promptTemplateNames(), ", "))
+			}
+			sources[name] = text
+		}
+	}
+	for name := range defaultPromptTemplates {
+		if text := os.Getenv(promptTemplateEnv(name)); text != "" {
+			sources[name] = text
+		}
+	}
+
+	templates := make(map[string]*template.Template, len(sources))
+	for name, text := range sources {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("prompt template %q: %w", name, err)
+		}
+		// Se ejecuta una vez para detectar al arrancar campos que no existen en promptData
+		if err := tmpl.Execute(&strings.Builder{}, promptData{}); err != nil {
+			return fmt.Errorf("prompt template %q: %w", name, err)
+		}
+		if text != defaultPromptTemplates[name] {
+			log.Printf("Using custom prompt template for %s", name)
+		}
+		templates[name] = tmpl
+	}
+	promptTemplates = templates
+	return nil
+}
+
+func promptTemplateEnv(name string) string {
+	return "PROMPT_TEMPLATE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func promptTemplateNames() []string {
+	names := make([]string, 0, len(defaultPromptTemplates))
+	for name := range defaultPromptTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderPrompt genera el prompt del endpoint name. Si la plantilla falla se usa la
+// instrucción por defecto, para no dejar la petición sin prompt.
+func renderPrompt(ctx context.Context, name string, data promptData) string {
+	tmpl := promptTemplates[name]
+	if tmpl == nil {
+		tmpl = template.Must(template.New(name).Parse(defaultPromptTemplates[name]))
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		logf(ctx, "Error rendering prompt template %s, using default: %v", name, err)
+		b.Reset()
+		template.Must(template.New(name).Parse(defaultPromptTemplates[name])).Execute(&b, data)
+	}
+	return strings.TrimSpace(b.String())
+}
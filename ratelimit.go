@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter aplica un token bucket por cliente: cada bucket admite hasta rpm
+// peticiones seguidas y se rellena a razón de rpm tokens por minuto.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rpm       float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rpm float64) *rateLimiter {
+	return &rateLimiter{
+		rpm:       rpm,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow consume un token del cliente. Si no quedan, devuelve cuánto falta para el siguiente.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.rpm, last: now}
+		l.buckets[client] = bucket
+	}
+	l.refill(bucket, now)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	missing := 1 - bucket.tokens
+	return false, time.Duration(missing / l.rpm * float64(time.Minute))
+}
+
+// refill añade los tokens acumulados desde la última consulta. Requiere l.mu.
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.last).Minutes()
+	bucket.last = now
+	bucket.tokens = min(l.rpm, bucket.tokens+elapsed*l.rpm)
+}
+
+// sweep elimina una vez por minuto los buckets que ya están llenos, para que el mapa
+// no crezca sin límite con clientes que solo llamaron una vez. Requiere l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Minutes()*l.rpm >= l.rpm {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitClient identifica al cliente por su API key o, si no la envía, por su IP.
+func rateLimitClient(r *http.Request) string {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("api_key")
+	}
+	if apiKey != "" {
+		return "key:" + apiKey
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimit rechaza con 429 las peticiones que superan RATE_LIMIT_RPM. Va antes de
+// validateAPIKey para que una petición rechazada no consuma el cupo de la key.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		ok, retryAfter := requestLimiter.allow(rateLimitClient(r))
+		if !ok {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, codeRateLimited, "Rate limit exceeded, retry later", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
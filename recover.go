@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery convierte un panic en un handler (o en el cliente de genai) en un 500 JSON
+// y registra la traza con el ID de la petición, en lugar de cortar la conexión sin más.
+func withRecovery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http usa este panic para abortar la respuesta a propósito
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+			logf(r.Context(), "Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			// Si la respuesta ya empezó no se puede cambiar el estado: solo queda cortarla
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rec, codeInternalError, "internal server error", http.StatusInternalServerError)
+		}()
+		next(rec, r)
+	}
+}
+
+// recoverJob es withRecovery para el código que corre fuera de un handler, como los
+// trabajos asíncronos: registra el panic y llama a onPanic en lugar de tumbar el proceso.
+func recoverJob(ctx context.Context, onPanic func()) {
+	if err := recover(); err != nil {
+		logf(ctx, "Panic in background job: %v\n%s", err, debug.Stack())
+		onPanic()
+	}
+}
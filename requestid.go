@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type requestIDContextKey struct{}
+
+const maxRequestIDLength = 128
+
+// withRequestID asigna un ID a cada petición, o reutiliza el de X-Request-ID si el
+// cliente o un proxy ya lo envía, y lo devuelve en la misma cabecera.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	}
+}
+
+// validRequestID acepta IDs razonables de texto imprimible, para que un valor del
+// cliente no pueda inyectar saltos de línea en los logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// logf escribe en el log habitual precedido del ID de la petición de ctx, si lo hay.
+func logf(ctx context.Context, format string, args ...any) {
+	if id := requestIDFromContext(ctx); id != "" {
+		log.Printf("[%s] %s", id, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
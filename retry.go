@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+var (
+	// Intentos totales por generación, incluido el primero (1 = sin reintentos)
+	retryMaxAttempts = 3
+	retryBaseDelay   = time.Second
+	retryMaxDelay    = 30 * time.Second
+)
+
+// retryGeneration ejecuta fn y la repite con backoff exponencial mientras falle con un
+// error transitorio de genai. Deja de reintentar en cuanto se cancela el contexto.
+func retryGeneration(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retryMaxAttempts || !retryableError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Backoff exponencial con jitter para no sincronizar los reintentos de varias peticiones
+		delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+		delay = delay/2 + rand.N(delay/2+1)
+		logf(ctx, "Transient genai error (attempt %d/%d), retrying in %s: %v", attempt, retryMaxAttempts, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// retryableError distingue los errores transitorios de genai (5xx y cuota agotada) de los
+// permanentes, como un prompt inválido o una API key sin permisos.
+func retryableError(err error) bool {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code >= http.StatusInternalServerError ||
+		apiErr.Code == http.StatusTooManyRequests ||
+		apiErr.Status == "RESOURCE_EXHAUSTED" ||
+		apiErr.Status == "UNAVAILABLE"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"google.golang.org/genai"
+)
+
+type safetyRatingsContextKey struct{}
+
+// safetyRating es la valoración de seguridad de una categoría tal como la devuelve el
+// modelo. Severity solo la rellena Vertex AI.
+type safetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+// safetyRatingsRecorder guarda las valoraciones del candidato que produjo la imagen. Con
+// reintentos se queda con las del último intento.
+type safetyRatingsRecorder struct {
+	mu      sync.Mutex
+	ratings []safetyRating
+}
+
+// withSafetyRatings prepara la petición para recoger las valoraciones de seguridad, que
+// writeImage devuelve en "safety_ratings" en las respuestas JSON.
+func withSafetyRatings(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), safetyRatingsContextKey{}, &safetyRatingsRecorder{})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func recordSafetyRatings(ctx context.Context, ratings []*genai.SafetyRating) {
+	if len(ratings) == 0 {
+		return
+	}
+	converted := make([]safetyRating, 0, len(ratings))
+	for _, rating := range ratings {
+		if rating == nil {
+			continue
+		}
+		converted = append(converted, safetyRating{
+			Category:    string(rating.Category),
+			Probability: string(rating.Probability),
+			Severity:    string(rating.Severity),
+			Blocked:     rating.Blocked,
+		})
+	}
+
+	setSafetyRatings(ctx, converted)
+}
+
+// setSafetyRatings sustituye las valoraciones de la petición; la caché lo usa para
+// devolver las de la imagen guardada.
+func setSafetyRatings(ctx context.Context, ratings []safetyRating) {
+	recorder, _ := ctx.Value(safetyRatingsContextKey{}).(*safetyRatingsRecorder)
+	if recorder == nil {
+		return
+	}
+	recorder.mu.Lock()
+	recorder.ratings = ratings
+	recorder.mu.Unlock()
+}
+
+// safetyRatingsFromContext devuelve las valoraciones recogidas; nunca nil, para que
+// "safety_ratings" sea siempre un array en el JSON.
+func safetyRatingsFromContext(ctx context.Context) []safetyRating {
+	recorder, _ := ctx.Value(safetyRatingsContextKey{}).(*safetyRatingsRecorder)
+	if recorder == nil {
+		return []safetyRating{}
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.ratings == nil {
+		return []safetyRating{}
+	}
+	return recorder.ratings
+}
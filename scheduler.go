@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+)
+
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+type priorityContextKey struct{}
+
+// laneScheduler reparte las llamadas a genai en carriles con capacidad reservada.
+// Una petición puede usar su propio carril o tomar prestado de carriles de menor
+// prioridad, nunca de uno superior: el trabajo batch (low) no puede ocupar la
+// capacidad reservada para peticiones interactivas (high/normal).
+type laneScheduler struct {
+	lanes map[string]chan struct{}
+}
+
+// Carriles que puede usar cada prioridad, en orden de preferencia
+var laneOrder = map[string][]string{
+	priorityHigh:   {priorityHigh, priorityNormal, priorityLow},
+	priorityNormal: {priorityNormal, priorityLow},
+	priorityLow:    {priorityLow},
+}
+
+func newLaneScheduler(high, normal, low int) *laneScheduler {
+	return &laneScheduler{
+		lanes: map[string]chan struct{}{
+			priorityHigh:   make(chan struct{}, high),
+			priorityNormal: make(chan struct{}, normal),
+			priorityLow:    make(chan struct{}, low),
+		},
+	}
+}
+
+// acquire espera un hueco para la prioridad dada y devuelve la función que lo libera.
+func (s *laneScheduler) acquire(ctx context.Context, priority string) (func(), error) {
+	order := laneOrder[priority]
+
+	// Primero se intenta sin bloquear, respetando el orden de preferencia
+	for _, name := range order {
+		lane := s.lanes[name]
+		select {
+		case lane <- struct{}{}:
+			return func() { <-lane }, nil
+		default:
+		}
+	}
+
+	// Si todos están llenos se espera al primer carril elegible que quede libre
+	switch len(order) {
+	case 3:
+		select {
+		case s.lanes[order[0]] <- struct{}{}:
+			return s.releaser(order[0]), nil
+		case s.lanes[order[1]] <- struct{}{}:
+			return s.releaser(order[1]), nil
+		case s.lanes[order[2]] <- struct{}{}:
+			return s.releaser(order[2]), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	case 2:
+		select {
+		case s.lanes[order[0]] <- struct{}{}:
+			return s.releaser(order[0]), nil
+		case s.lanes[order[1]] <- struct{}{}:
+			return s.releaser(order[1]), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	default:
+		select {
+		case s.lanes[order[0]] <- struct{}{}:
+			return s.releaser(order[0]), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *laneScheduler) releaser(name string) func() {
+	lane := s.lanes[name]
+	return func() { <-lane }
+}
+
+func validPriority(priority string) bool {
+	switch priority {
+	case "", priorityHigh, priorityNormal, priorityLow:
+		return true
+	}
+	return false
+}
+
+func withPriority(ctx context.Context, priority string) context.Context {
+	if priority == "" {
+		priority = priorityNormal
+	}
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context) string {
+	if priority, ok := ctx.Value(priorityContextKey{}).(string); ok {
+		return priority
+	}
+	return priorityNormal
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// progressFunc recibe las partes de texto del stream de genai a medida que llegan.
+// kind es "text" o "thought".
+type progressFunc func(kind, text string)
+
+type progressContextKey struct{}
+
+func withProgress(ctx context.Context, progress progressFunc) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, progress)
+}
+
+func progressFromContext(ctx context.Context) progressFunc {
+	progress, _ := ctx.Value(progressContextKey{}).(progressFunc)
+	return progress
+}
+
+// acceptsEventStream indica si el cliente pide la respuesta como Server-Sent Events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// sseWriter escribe eventos SSE con datos JSON y los envía al cliente en cuanto se generan.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sse := &sseWriter{w: w, rc: http.NewResponseController(w)}
+	sse.rc.Flush()
+	return sse
+}
+
+func (s *sseWriter) event(name string, data any) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, payload)
+	s.rc.Flush()
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageStore guarda las imágenes generadas en un backend. url devuelve la URL con la que
+// el cliente puede descargar la imagen name y signedURL una que deja de valer en expires.
+type imageStore interface {
+	save(ctx context.Context, name string, data []byte, mimeType string) error
+	exists(ctx context.Context, name string) (bool, error)
+	url(name string) string
+	signedURL(name string, expires time.Time) string
+}
+
+var (
+	// nil cuando STORAGE_BACKEND no está configurado: las imágenes se devuelven en la respuesta
+	imageStorage imageStore
+
+	// Validez de las URLs firmadas (STORAGE_URL_TTL_SECONDS); 0 = URLs públicas
+	storageURLTTL time.Duration
+)
+
+// Validez máxima de una URL firmada: el límite de las URLs prefirmadas de S3
+const maxStorageURLTTL = 7 * 24 * time.Hour
+
+// Estrategias de STORAGE_KEY_STRATEGY para nombrar las imágenes guardadas
+const (
+	storageKeyContentHash = "content-hash"
+	storageKeyUUID        = "uuid"
+	storageKeyPromptSlug  = "prompt-slug"
+)
+
+var (
+	storageKeyStrategies = []string{storageKeyContentHash, storageKeyUUID, storageKeyPromptSlug}
+	storageKeyStrategy   = storageKeyContentHash
+)
+
+// Longitud máxima del slug del prompt en los nombres de prompt-slug
+const maxPromptSlugLength = 60
+
+type storagePromptContextKey struct{}
+
+// withStoragePrompt guarda en la petición el prompt del usuario, del que sale el nombre
+// de la imagen con STORAGE_KEY_STRATEGY=prompt-slug.
+func withStoragePrompt(r *http.Request, prompt string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), storagePromptContextKey{}, prompt))
+}
+
+// storeImage guarda la imagen con el nombre que le corresponde y devuelve su URL. Con
+// content-hash el nombre identifica el contenido, así que una imagen repetida (p. ej.
+// servida desde la caché) no se vuelve a subir.
+func storeImage(ctx context.Context, data []byte, mimeType string) (string, error) {
+	name := storedImageName(ctx, data, mimeType)
+	if storageKeyStrategy == storageKeyContentHash {
+		exists, err := imageStorage.exists(ctx, name)
+		if err != nil {
+			// Ante la duda se sube: sobrescribir con el mismo contenido es inocuo
+			logf(ctx, "Error checking stored image %s: %v", name, err)
+		} else if exists {
+			return storedImageURL(name), nil
+		}
+	}
+	if err := imageStorage.save(ctx, name, data, mimeType); err != nil {
+		return "", err
+	}
+	return storedImageURL(name), nil
+}
+
+// storedImageURL devuelve la URL firmada de la imagen si STORAGE_URL_TTL_SECONDS está
+// configurado y la pública si no.
+func storedImageURL(name string) string {
+	if storageURLTTL > 0 {
+		return imageStorage.signedURL(name, time.Now().Add(storageURLTTL))
+	}
+	return imageStorage.url(name)
+}
+
+// storedImageName nombra la imagen según STORAGE_KEY_STRATEGY: el hash SHA-256 del
+// contenido, un ID aleatorio o el prompt en forma de slug seguido de un sufijo aleatorio.
+func storedImageName(ctx context.Context, data []byte, mimeType string) string {
+	ext := ".png"
+	switch mimeType {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/webp":
+		ext = ".webp"
+	}
+
+	switch storageKeyStrategy {
+	case storageKeyUUID:
+		return newRequestID() + ext
+	case storageKeyPromptSlug:
+		prompt, _ := ctx.Value(storagePromptContextKey{}).(string)
+		return promptSlug(prompt) + "-" + newRequestID()[:8] + ext
+	default:
+		return sha256Hex(data) + ext
+	}
+}
+
+// promptSlug deja el prompt en minúsculas ASCII separadas por guiones, sin tildes. Sin
+// prompt (endpoints que solo editan) devuelve "image".
+func promptSlug(prompt string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(prompt) {
+		if folded, ok := slugFolding[r]; ok {
+			r = folded
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			dash = false
+			if slug.Len() >= maxPromptSlugLength {
+				break
+			}
+			slug.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	if slug.Len() == 0 {
+		return "image"
+	}
+	return slug.String()
+}
+
+var slugFolding = map[rune]rune{
+	'á': 'a', 'à': 'a', 'ä': 'a', 'â': 'a', 'ã': 'a',
+	'é': 'e', 'è': 'e', 'ë': 'e', 'ê': 'e',
+	'í': 'i', 'ì': 'i', 'ï': 'i', 'î': 'i',
+	'ó': 'o', 'ò': 'o', 'ö': 'o', 'ô': 'o', 'õ': 'o',
+	'ú': 'u', 'ù': 'u', 'ü': 'u', 'û': 'u',
+	'ñ': 'n', 'ç': 'c',
+}
+
+// localStore escribe las imágenes en un directorio que el propio servidor publica.
+type localStore struct {
+	dir     string
+	baseURL string
+	// Clave HMAC de las URLs firmadas (STORAGE_URL_SECRET)
+	urlKey []byte
+}
+
+func (s *localStore) save(ctx context.Context, name string, data []byte, mimeType string) error {
+	// Se escribe en un temporal y se renombra para no servir nunca un fichero a medias
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localStore) url(name string) string {
+	return s.baseURL + "/" + name
+}
+
+// signedURL añade a la URL la caducidad y su firma HMAC, que comprueba storedImagesHandler.
+func (s *localStore) signedURL(name string, expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	return s.url(name) + "?expires=" + unix + "&signature=" + s.urlSignature(name, unix)
+}
+
+func (s *localStore) urlSignature(name, expires string) string {
+	return hex.EncodeToString(hmacSHA256(s.urlKey, name+"\n"+expires))
+}
+
+// checkSignedURL valida la firma y la caducidad de una URL de signedURL.
+func (s *localStore) checkSignedURL(name string, query url.Values) error {
+	expires := query.Get("expires")
+	if expires == "" || !hmac.Equal([]byte(query.Get("signature")), []byte(s.urlSignature(name, expires))) {
+		return errors.New("invalid signature")
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return errors.New("signed URL expired")
+	}
+	return nil
+}
+
+// s3Store sube las imágenes a un bucket compatible con S3 (AWS, MinIO, R2...) con
+// peticiones PUT firmadas con AWS Signature V4, usando URLs de tipo path-style.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	publicURL string
+	client    *http.Client
+}
+
+func (s *s3Store) objectURL(name string) *url.URL {
+	objectURL := *s.endpoint
+	objectURL.Path = strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.bucket + "/" + name
+	return &objectURL
+}
+
+func (s *s3Store) save(ctx context.Context, name string, data []byte, mimeType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(name).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	s.sign(req, data, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage upload failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// exists consulta el objeto con un HEAD firmado: 200 si existe y 404 si no.
+func (s *s3Store) exists(ctx context.Context, name string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(name).String(), nil)
+	if err != nil {
+		return false, err
+	}
+	s.sign(req, nil, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("storage lookup failed: %s", resp.Status)
+	}
+}
+
+func (s *s3Store) url(name string) string {
+	if s.publicURL != "" {
+		return s.publicURL + "/" + name
+	}
+	return s.objectURL(name).String()
+}
+
+// signedURL prefirma un GET del objeto con AWS Signature V4 en la query. La firma va
+// ligada al host de S3_ENDPOINT, así que S3_PUBLIC_URL no se usa.
+func (s *s3Store) signedURL(name string, expires time.Time) string {
+	now := time.Now()
+	return s.presign(s.objectURL(name), now, expires.Sub(now))
+}
+
+// presign firma un GET de objectURL válido durante ttl desde now.
+func (s *s3Store) presign(objectURL *url.URL, now time.Time, ttl time.Duration) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	// Encode ordena por clave y escapa como pide la query canónica de SigV4
+	objectURL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		objectURL.EscapedPath(),
+		objectURL.RawQuery,
+		"host:" + objectURL.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(date), stringToSign))
+
+	objectURL.RawQuery += "&X-Amz-Signature=" + signature
+	return objectURL.String()
+}
+
+// sign añade a req las cabeceras de AWS Signature V4 para el servicio s3. Content-Type
+// solo se firma si la petición lo lleva (un HEAD no).
+func (s *s3Store) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(date), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// signingKey deriva la clave de firma SigV4 del día date (AAAAMMDD).
+func (s *s3Store) signingKey(date string) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// newImageStore crea el backend de STORAGE_BACKEND a partir de sus variables de entorno.
+func newImageStore(backend string) (imageStore, error) {
+	switch backend {
+	case "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "images"
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		baseURL := strings.TrimSuffix(os.Getenv("STORAGE_BASE_URL"), "/")
+		if baseURL == "" {
+			baseURL = "/images"
+		}
+		urlKey := []byte(os.Getenv("STORAGE_URL_SECRET"))
+		if len(urlKey) == 0 {
+			// Sin secreto las URLs firmadas dejan de valer al reiniciar
+			urlKey = make([]byte, 32)
+			if _, err := rand.Read(urlKey); err != nil {
+				return nil, err
+			}
+			if storageURLTTL > 0 {
+				log.Printf("Warning: STORAGE_URL_SECRET is not set, signed image URLs will not survive a restart")
+			}
+		}
+		return &localStore{dir: dir, baseURL: baseURL, urlKey: urlKey}, nil
+	case "s3":
+		endpoint, err := url.Parse(os.Getenv("S3_ENDPOINT"))
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT must be an absolute URL")
+		}
+		store := &s3Store{
+			endpoint:  endpoint,
+			bucket:    os.Getenv("S3_BUCKET"),
+			region:    os.Getenv("S3_REGION"),
+			accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			publicURL: strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		if store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+			return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (use local or s3)", backend)
+	}
+}
+
+// storedImagesHandler publica en /images/ las imágenes del backend local, sin listar
+// el directorio. Con STORAGE_URL_TTL_SECONDS solo se sirven con una URL firmada vigente.
+func storedImagesHandler(store *localStore) http.Handler {
+	files := http.StripPrefix("/images/", http.FileServer(http.Dir(store.dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/images/")
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			writeError(w, codeNotFound, "image not found", http.StatusNotFound)
+			return
+		}
+		if storageURLTTL > 0 {
+			if err := store.checkSignedURL(name, r.URL.Query()); err != nil {
+				writeError(w, codeForbidden, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		// El FileServer respondería el 404 en texto plano
+		if info, err := os.Stat(filepath.Join(store.dir, name)); err != nil || !info.Mode().IsRegular() {
+			writeError(w, codeNotFound, "image not found", http.StatusNotFound)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Memoria máxima para un formulario multipart; lo que exceda va a ficheros temporales
+const maxMultipartMemory = 32 << 20
+
+// contentTypeError es un body con un Content-Type que el endpoint no admite.
+type contentTypeError struct {
+	mediaType string
+	allowed   string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("unsupported Content-Type %q, use %s", e.mediaType, e.allowed)
+}
+
+// requestMediaType devuelve el tipo del Content-Type sin parámetros, o la cabecera tal
+// cual si no se puede interpretar.
+func requestMediaType(r *http.Request) string {
+	header := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return strings.TrimSpace(header)
+	}
+	return mediaType
+}
+
+// isJSONMediaType acepta application/json y los tipos +json. Sin Content-Type se sigue
+// asumiendo JSON para no romper a los clientes que no lo envían.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON lee el body en req en los endpoints que solo admiten JSON.
+func decodeJSON(r *http.Request, req any) error {
+	if mediaType := requestMediaType(r); !isJSONMediaType(mediaType) {
+		return &contentTypeError{mediaType: mediaType, allowed: "application/json"}
+	}
+	return json.NewDecoder(r.Body).Decode(req)
+}
+
+// decodeRequest lee el body en req. Con Content-Type multipart/form-data, los campos de
+// texto se asignan a los campos de req según su etiqueta json y los ficheros se
+// devuelven, ya leídos, indexados por el nombre del campo del formulario. Con JSON no
+// hay ficheros; cualquier otro Content-Type se rechaza.
+func decodeRequest(r *http.Request, req any) (map[string][]byte, error) {
+	mediaType := requestMediaType(r)
+	if isJSONMediaType(mediaType) {
+		return nil, json.NewDecoder(r.Body).Decode(req)
+	}
+	if mediaType != "multipart/form-data" {
+		return nil, &contentTypeError{mediaType: mediaType, allowed: "application/json or multipart/form-data"}
+	}
+
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if err := setFormFields(reflect.ValueOf(req).Elem(), r.MultipartForm.Value); err != nil {
+		return nil, err
+	}
+
+	uploads := make(map[string][]byte)
+	for name, headers := range r.MultipartForm.File {
+		if len(headers) == 0 {
+			continue
+		}
+		file, err := headers[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		uploads[name] = data
+	}
+	return uploads, nil
+}
+
+// setFormFields convierte los valores de texto del formulario al tipo de cada campo.
+func setFormFields(dst reflect.Value, values map[string][]string) error {
+	for i := 0; i < dst.NumField(); i++ {
+		// Los parámetros comunes (commonImageOptions) van en un struct incrustado
+		if sf := dst.Type().Field(i); sf.Anonymous && sf.Tag.Get("json") == "" && sf.Type.Kind() == reflect.Struct {
+			if err := setFormFields(dst.Field(i), values); err != nil {
+				return err
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(dst.Type().Field(i).Tag.Get("json"), ",")
+		formValues, ok := values[name]
+		if name == "" || name == "-" || !ok || len(formValues) == 0 {
+			continue
+		}
+
+		field := dst.Field(i)
+		// Tipos propios como watermarkOption saben interpretarse desde texto
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			if err := u.UnmarshalText([]byte(formValues[0])); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", name, err)
+			}
+			continue
+		}
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+			field.Set(reflect.ValueOf(formValues))
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+		if err := setFormValue(field, formValues[0]); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setFormValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// uploadedImage devuelve el fichero subido en el campo name o, si no lo hay, la imagen
+// en base64 de b64, ya enderezada según su EXIF. Si no llegó ninguna de las dos devuelve nil.
+func uploadedImage(uploads map[string][]byte, name, b64 string) ([]byte, error) {
+	if data, ok := uploads[name]; ok {
+		return autoOrient(data), nil
+	}
+	if b64 == "" {
+		return nil, nil
+	}
+	data, err := decodeBase64Image(b64)
+	if err != nil {
+		return nil, err
+	}
+	return autoOrient(data), nil
+}
+
+// base64Encodings son las variantes que aceptan los campos de imagen, de la más habitual
+// a la menos.
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeBase64Image decodifica una imagen en base64 tal como la mandan los clientes:
+// con o sin prefijo data URI (data:image/png;base64,), estándar o URL-safe, con o sin
+// padding y con saltos de línea.
+func decodeBase64Image(b64 string) ([]byte, error) {
+	b64 = strings.TrimSpace(b64)
+	if len(b64) > 5 && strings.EqualFold(b64[:5], "data:") {
+		comma := strings.IndexByte(b64, ',')
+		if comma < 0 || !strings.HasSuffix(strings.ToLower(b64[:comma]), ";base64") {
+			return nil, errors.New("data URI is not base64 encoded")
+		}
+		b64 = b64[comma+1:]
+	}
+	b64 = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, b64)
+
+	var err error
+	for _, encoding := range base64Encodings {
+		var data []byte
+		if data, err = encoding.DecodeString(b64); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// imageProvided indica si la petición trae la imagen name por alguna vía.
+func imageProvided(uploads map[string][]byte, name, b64, imageURL, uploadID string) bool {
+	return uploads[name] != nil || b64 != "" || imageURL != "" || uploadID != ""
+}
+
+// requestImage es uploadedImage con image_url y image_upload_id (una subida por partes
+// ya completa) como vías adicionales. Si la imagen llega por más de una vía devuelve
+// errMultipleImageSources.
+func requestImage(ctx context.Context, uploads map[string][]byte, name, b64, imageURL, uploadID string) ([]byte, error) {
+	if imageURL == "" && uploadID == "" {
+		return uploadedImage(uploads, name, b64)
+	}
+	if uploads[name] != nil || b64 != "" || (imageURL != "" && uploadID != "") {
+		return nil, errMultipleImageSources
+	}
+	var data []byte
+	var err error
+	if uploadID != "" {
+		data, err = chunkedUploads.read(uploadID, apiKeyFromContext(ctx))
+	} else {
+		data, err = fetchImage(ctx, imageURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return autoOrient(data), nil
+}
+
+// writeImageSourceError responde al error de requestImage. base64Message es el mensaje
+// para un Base64 inválido, que depende del campo.
+func writeImageSourceError(w http.ResponseWriter, err error, base64Message string) {
+	var urlErr *imageURLError
+	switch {
+	case errors.Is(err, errMultipleImageSources):
+		writeError(w, codeInvalidParameter, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &urlErr):
+		writeError(w, codeInvalidImageURL, urlErr.Error(), http.StatusBadRequest)
+	case errors.Is(err, errUploadNotFound):
+		writeError(w, codeUploadNotFound, "image_upload_id: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errUploadIncomplete):
+		writeError(w, codeUploadIncomplete, "image_upload_id: "+err.Error(), http.StatusConflict)
+	default:
+		writeError(w, codeInvalidBase64, base64Message, http.StatusBadRequest)
+	}
+}
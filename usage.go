@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/genai"
+)
+
+// usageCounter acumula los tokens que consume una petición en todas sus llamadas a
+// genai (reintentos y generaciones en paralelo incluidos).
+type usageCounter struct {
+	prompt atomic.Int64
+	output atomic.Int64
+	total  atomic.Int64
+}
+
+type usageContextKey struct{}
+
+// tokenUsage es el resumen de consumo que se añade a las respuestas JSON.
+type tokenUsage struct {
+	PromptTokens int64 `json:"prompt_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+	TotalTokens  int64 `json:"total_tokens"`
+}
+
+// recordUsage suma el consumo de una llamada. Los metadatos del stream son acumulados,
+// así que se pasa el último recibido.
+func recordUsage(ctx context.Context, metadata *genai.GenerateContentResponseUsageMetadata) {
+	counter, _ := ctx.Value(usageContextKey{}).(*usageCounter)
+	if counter == nil || metadata == nil {
+		return
+	}
+	counter.prompt.Add(int64(metadata.PromptTokenCount))
+	counter.output.Add(int64(metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount))
+	counter.total.Add(int64(metadata.TotalTokenCount))
+}
+
+// usageFromContext devuelve el consumo acumulado, o nil si no hubo llamadas con metadatos.
+func usageFromContext(ctx context.Context) *tokenUsage {
+	counter, _ := ctx.Value(usageContextKey{}).(*usageCounter)
+	if counter == nil || counter.total.Load() == 0 {
+		return nil
+	}
+	return &tokenUsage{
+		PromptTokens: counter.prompt.Load(),
+		OutputTokens: counter.output.Load(),
+		TotalTokens:  counter.total.Load(),
+	}
+}
+
+// withUsage devuelve en la cabecera X-Usage-Tokens el total de tokens consumidos por
+// la petición, también cuando la respuesta es un error.
+func withUsage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counter := &usageCounter{}
+		ctx := context.WithValue(r.Context(), usageContextKey{}, counter)
+		next(&usageWriter{ResponseWriter: w, counter: counter}, r.WithContext(ctx))
+	}
+}
+
+// usageWriter añade X-Usage-Tokens justo antes de escribir la respuesta.
+type usageWriter struct {
+	http.ResponseWriter
+	counter     *usageCounter
+	wroteHeader bool
+}
+
+func (w *usageWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if total := w.counter.total.Load(); total > 0 {
+			w.Header().Set("X-Usage-Tokens", fmt.Sprintf("%d", total))
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *usageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// addUsage añade a un body JSON el consumo de la petición en el campo "usage", si lo hay.
+func addUsage(ctx context.Context, body map[string]interface{}) map[string]interface{} {
+	if usage := usageFromContext(ctx); usage != nil {
+		body["usage"] = usage
+	}
+	return body
+}
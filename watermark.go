@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Marca de agua para etiquetar las imágenes generadas. Se aplica sobre la imagen ya
+// generada, así que la caché guarda siempre la versión sin marca.
+var (
+	watermarkText     = defaultWatermarkText
+	watermarkLogo     image.Image // nil = se usa el texto
+	watermarkPosition = "bottom-right"
+	watermarkOpacity  = 0.5
+)
+
+const defaultWatermarkText = "AI generated"
+
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// watermarkOption es el campo "watermark" de la petición: true aplica la marca
+// configurada y un texto la sustituye por ese texto.
+type watermarkOption struct {
+	Enabled bool
+	Text    string
+}
+
+func (o *watermarkOption) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*o = watermarkOption{Enabled: enabled}
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("watermark must be a boolean or a string")
+	}
+	*o = watermarkOption{Enabled: text != "", Text: text}
+	return nil
+}
+
+// UnmarshalText lee el campo desde un formulario multipart, donde todo llega como texto.
+func (o *watermarkOption) UnmarshalText(data []byte) error {
+	if enabled, err := strconv.ParseBool(string(data)); err == nil {
+		*o = watermarkOption{Enabled: enabled}
+		return nil
+	}
+	*o = watermarkOption{Enabled: len(data) > 0, Text: string(data)}
+	return nil
+}
+
+const maxWatermarkTextLength = 100
+
+func (o watermarkOption) validate() error {
+	if len(o.Text) > maxWatermarkTextLength {
+		return fmt.Errorf("watermark text must be at most %d characters", maxWatermarkTextLength)
+	}
+	return nil
+}
+
+// loadWatermarkLogo lee el logo de WATERMARK_IMAGE (PNG con transparencia, normalmente).
+func loadWatermarkLogo(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data)
+}
+
+// applyWatermark devuelve la imagen con la marca de agua si la petición la pidió, en el
+// mismo formato (JPEG sigue en JPEG, el resto pasa a PNG).
+func applyWatermark(img []byte, mimeType string, opt watermarkOption) ([]byte, string, error) {
+	if !opt.Enabled {
+		return img, mimeType, nil
+	}
+	src, err := decodeImage(img)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	mark := watermarkLogo
+	if mark == nil || opt.Text != "" {
+		text := opt.Text
+		if text == "" {
+			text = watermarkText
+		}
+		mark = renderWatermarkText(text)
+	}
+	drawWatermark(dst, mark)
+	return encodeImage(dst, mimeType)
+}
+
+// renderWatermarkText dibuja el texto en blanco con una sombra oscura, para que se lea
+// sobre fondos claros y oscuros.
+func renderWatermarkText(text string) image.Image {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 1
+	height := face.Metrics().Height.Ceil() + 1
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	ascent := face.Metrics().Ascent
+	for _, layer := range []struct {
+		offset int
+		color  color.Color
+	}{{1, color.RGBA{0, 0, 0, 160}}, {0, color.White}} {
+		d := &font.Drawer{
+			Dst:  img,
+			Src:  image.NewUniform(layer.color),
+			Face: face,
+			Dot:  fixed.Point26_6{X: fixed.I(layer.offset), Y: ascent + fixed.I(layer.offset)},
+		}
+		d.DrawString(text)
+	}
+	return img
+}
+
+// drawWatermark escala la marca (ampliándola si hace falta, el texto base es muy pequeño)
+// para que ocupe un cuarto del ancho o un décimo del alto de la imagen, lo que limite
+// antes, y la compone con la opacidad configurada.
+func drawWatermark(dst *image.RGBA, mark image.Image) {
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	mb := mark.Bounds()
+	scale := min(float64(max(width/4, 1))/float64(mb.Dx()), float64(max(height/10, 1))/float64(mb.Dy()))
+	markW, markH := max(int(float64(mb.Dx())*scale), 1), max(int(float64(mb.Dy())*scale), 1)
+	scaled := scaleImage(mark, markW, markH)
+
+	margin := min(width, height) / 50
+	var x, y int
+	switch watermarkPosition {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = width-markW-margin, margin
+	case "bottom-left":
+		x, y = margin, height-markH-margin
+	case "center":
+		x, y = (width-markW)/2, (height-markH)/2
+	default:
+		x, y = width-markW-margin, height-markH-margin
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(watermarkOpacity * 255)})
+	draw.DrawMask(dst, image.Rect(x, y, x+markW, y+markH), scaled, image.Point{}, mask, image.Point{}, draw.Over)
+}